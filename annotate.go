@@ -0,0 +1,40 @@
+package xray_grpc
+
+import (
+	"context"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Adds an annotation to the (sub)segment in ctx, with the same length limits the interceptors apply to their own
+// annotations. Does nothing when ctx has no segment, e.g. when tracing is disabled or the call was not intercepted.
+// Usage:
+//
+// func (s *server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+//     xray_grpc.AddAnnotation(ctx, "tenant", req.TenantId)
+//     ...
+// }
+//
+func AddAnnotation(ctx context.Context, key string, value interface{}) {
+	if seg := xray.GetSegment(ctx); seg != nil {
+		defaultOptions.addAnnotation(xraySegment{seg}, key, value)
+	}
+}
+
+// Adds metadata under key in namespace ns to the (sub)segment in ctx, an empty ns selects the SDK's "default"
+// namespace. Does nothing when ctx has no segment.
+// Usage:
+//
+// xray_grpc.AddMetadata(ctx, "orders", "items", req.Items)
+//
+func AddMetadata(ctx context.Context, ns, key string, value interface{}) {
+	seg := xray.GetSegment(ctx)
+	if seg == nil {
+		return
+	}
+	if ns == "" {
+		defaultOptions.addMetadata(xraySegment{seg}, key, value)
+		return
+	}
+	defaultOptions.addMetadataToNamespace(xraySegment{seg}, ns, key, value)
+}
@@ -0,0 +1,36 @@
+package xray_grpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+func TestAddAnnotationAndMetadata(t *testing.T) {
+	ctx, seg := xray.BeginSegment(context.Background(), "test")
+	defer seg.Close(nil)
+
+	AddAnnotation(ctx, "tenant", "acme")
+	AddAnnotation(ctx, "long", strings.Repeat("x", 2*maxAnnotationValueLength))
+	AddMetadata(ctx, "orders", "items", 3)
+	AddMetadata(ctx, "", "note", "hello")
+
+	assertAnnotation(t, seg, "tenant", "acme")
+	if got, _ := annotations(seg)["long"].(string); len(got) != maxAnnotationValueLength {
+		t.Errorf("long annotation has %d characters, want it truncated to %d", len(got), maxAnnotationValueLength)
+	}
+	if got := metadataIn(seg, "orders")["items"]; got != 3 {
+		t.Errorf("orders.items = %v, want 3", got)
+	}
+	if got := metadataOf(seg)["note"]; got != "hello" {
+		t.Errorf("default.note = %v, want hello", got)
+	}
+}
+
+func TestAddAnnotationAndMetadataWithoutSegment(t *testing.T) {
+	// Handlers may run untraced, which must not panic
+	AddAnnotation(context.Background(), "tenant", "acme")
+	AddMetadata(context.Background(), "orders", "items", 3)
+}
@@ -0,0 +1,52 @@
+package xray_grpc
+
+import (
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Observes the response headers set by a handler for the header configured with WithAppStatusHeader
+type appStatusRecorder struct {
+	key string
+
+	mu    sync.Mutex
+	value string
+}
+
+func (r *appStatusRecorder) observe(md metadata.MD) {
+	if values := md.Get(r.key); len(values) > 0 {
+		r.mu.Lock()
+		// Like grpc-go merging headers, the last value set wins
+		r.value = values[len(values)-1]
+		r.mu.Unlock()
+	}
+}
+
+// Annotates seg with the observed value as app.status, if the handler set one. seg must not be locked.
+func (r *appStatusRecorder) record(o *options, seg *xray.Segment) {
+	r.mu.Lock()
+	value := r.value
+	r.mu.Unlock()
+	if value != "" {
+		o.addAnnotation(xraySegment{seg}, "app.status", value)
+	}
+}
+
+// Wraps the transport stream of a unary call, which grpc.SetHeader and grpc.SendHeader write to
+type appStatusTransportStream struct {
+	grpc.ServerTransportStream
+	recorder *appStatusRecorder
+}
+
+func (s *appStatusTransportStream) SetHeader(md metadata.MD) error {
+	s.recorder.observe(md)
+	return s.ServerTransportStream.SetHeader(md)
+}
+
+func (s *appStatusTransportStream) SendHeader(md metadata.MD) error {
+	s.recorder.observe(md)
+	return s.ServerTransportStream.SendHeader(md)
+}
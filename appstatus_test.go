@@ -0,0 +1,69 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestAppStatusHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header metadata.MD
+		want   string
+	}{
+		{"set", metadata.Pairs("grpc-status-detail", "QUOTA_LOW"), "QUOTA_LOW"},
+		{"last value wins", metadata.Pairs("grpc-status-detail", "RETRYING", "grpc-status-detail", "DEGRADED"), "DEGRADED"},
+		{"other header", metadata.Pairs("x-other", "QUOTA_LOW"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &testServer{unary: func(ctx context.Context, _ *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+				return &testpb.SimpleResponse{}, grpc.SetHeader(ctx, tt.header)
+			}}
+			interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithAppStatusHeader("grpc-status-detail"))
+			client := startTestServer(t, srv, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)})
+			var header metadata.MD
+			if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}, grpc.Header(&header)); err != nil {
+				t.Fatal(err)
+			}
+			// The handler's header still reaches the client
+			if got := header.Get("grpc-status-detail"); len(got) != len(tt.header.Get("grpc-status-detail")) {
+				t.Errorf("client received %v", got)
+			}
+			seg := srv.segment()
+			waitClosed(t, seg)
+			if tt.want == "" {
+				assertNoAnnotation(t, seg, "app.status")
+			} else {
+				assertAnnotation(t, seg, "app.status", tt.want)
+			}
+		})
+	}
+}
+
+// A server stream that accepts response headers
+type headerServerStream struct {
+	idleServerStream
+}
+
+func (s *headerServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *headerServerStream) SendHeader(metadata.MD) error { return nil }
+
+func TestAppStatusHeaderOnStream(t *testing.T) {
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithAppStatusHeader("grpc-status-detail"))
+	ss := &headerServerStream{idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}}
+	var seg *xray.Segment
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(_ interface{}, stream grpc.ServerStream) error {
+		seg = xray.GetSegment(stream.Context())
+		return stream.SendHeader(metadata.Pairs("grpc-status-detail", "PARTIAL"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnnotation(t, seg, "app.status", "PARTIAL")
+}
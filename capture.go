@@ -0,0 +1,73 @@
+package xray_grpc
+
+import (
+	"context"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Options used by the package level helpers, which are not tied to an interceptor
+var defaultOptions = newOptions(nil)
+
+// Thin wrapper over xray.Capture for handlers that call remote services without going through the client
+// interceptor. The subsegment is named name, marked as remote and, like the client interceptor's subsegments, given
+// the closest HTTP status, flags and annotations from the (gRPC status) error returned by fn.
+// Usage:
+//
+// err := xray_grpc.CaptureGRPCSubsegment(ctx, "inventory", func(ctx context.Context) error {
+//     _, err := inventoryClient.Reserve(ctx, req)
+//     return err
+// })
+//
+func CaptureGRPCSubsegment(ctx context.Context, name string, fn func(context.Context) error) error {
+	// The error is recorded with its status, closing the subsegment with it would flag every error as a fault
+	var err error
+	xray.Capture(ctx, name, func(ctx context.Context) error {
+		seg := xray.GetSegment(ctx)
+
+		// If no segment is found, continue on
+		if seg == nil {
+			err = fn(ctx)
+			return nil
+		}
+
+		trackSubsegment(ctx, seg.ID)
+
+		seg.Lock()
+		seg.Namespace = "remote"
+		seg.Unlock()
+
+		err = fn(ctx)
+
+		defaultOptions.recordOutcome(xraySegment{seg}, err, true)
+
+		return nil
+	})
+	return err
+}
+
+// Times an authentication or authorization check in an "authz" subsegment. When fn returns an error the
+// subsegment is flagged as an error (not a fault, the caller was refused) and the error is recorded as an
+// exception. The error of fn is returned unchanged.
+// Usage:
+//
+// err := xray_grpc.CaptureAuth(ctx, func(ctx context.Context) error {
+//     return authorizer.Authorize(ctx, info.FullMethod)
+// })
+//
+func CaptureAuth(ctx context.Context, fn func(context.Context) error) error {
+	var err error
+	xray.Capture(ctx, "authz", func(ctx context.Context) error {
+		err = fn(ctx)
+
+		// Closing the subsegment with the error would flag it as a fault
+		if seg := xray.GetSegment(ctx); seg != nil && err != nil {
+			seg.Lock()
+			seg.Error = true
+			addException(seg, err)
+			seg.Unlock()
+		}
+		return nil
+	})
+	return err
+}
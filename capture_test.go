@@ -0,0 +1,84 @@
+package xray_grpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCaptureGRPCSubsegment(t *testing.T) {
+	var sub *xray.Segment
+	var ids []string
+	_, _, err := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		err := CaptureGRPCSubsegment(ctx, "inventory", func(ctx context.Context) error {
+			sub = xray.GetSegment(ctx)
+			return status.Error(codes.NotFound, "no such item")
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("err = %v, want the error of fn", err)
+		}
+		ids = SubsegmentIDsFromContext(ctx)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub == nil || sub.Name != "inventory" {
+		t.Fatalf("fn ran in %v, want a subsegment named inventory", sub)
+	}
+	sub.RLock()
+	namespace := sub.Namespace
+	sub.RUnlock()
+	if namespace != "remote" {
+		t.Errorf("namespace = %q, want remote", namespace)
+	}
+	assertAnnotation(t, sub, "error.class", ErrorClassClient)
+	assertAnnotation(t, sub, "grpc.outcome", OutcomeClientError)
+	// Like the client interceptor, a NotFound is the caller's error rather than a fault
+	if code, fault, isError, throttle := segmentStatus(sub); code != 404 || fault || !isError || throttle {
+		t.Errorf("status %d, fault %t, error %t, throttle %t, want 404 flagged as an error", code, fault, isError, throttle)
+	}
+	sub.RLock()
+	exceptions := len(sub.GetCause().Exceptions)
+	sub.RUnlock()
+	if exceptions != 1 {
+		t.Errorf("%d exceptions, want the error of fn", exceptions)
+	}
+	if got := metadataOf(sub)["grpc.status_text"]; got != "Not Found" {
+		t.Errorf("grpc.status_text = %v, want Not Found", got)
+	}
+	if !reflect.DeepEqual(ids, []string{sub.ID}) {
+		t.Errorf("tracked subsegments = %v, want %s", ids, sub.ID)
+	}
+}
+
+func TestCaptureAuth(t *testing.T) {
+	denied := status.Error(codes.PermissionDenied, "not allowed")
+	for _, want := range []error{nil, denied} {
+		ctx, root := xray.BeginSegment(context.Background(), "test")
+		var sub *xray.Segment
+		err := CaptureAuth(ctx, func(ctx context.Context) error {
+			sub = xray.GetSegment(ctx)
+			return want
+		})
+		root.Close(nil)
+		if err != want {
+			t.Errorf("err = %v, want %v unchanged", err, want)
+		}
+		if sub == nil || sub.Name != "authz" || !segmentClosed(sub) {
+			t.Fatalf("fn ran in %v, want a closed authz subsegment", sub)
+		}
+		_, fault, isErr, _ := segmentStatus(sub)
+		sub.RLock()
+		exceptions := len(sub.GetCause().Exceptions)
+		sub.RUnlock()
+		if fault || isErr != (want != nil) || exceptions != btoi(want != nil) {
+			t.Errorf("%v: fault %t, error %t, %d exceptions, want an error without fault only when refused", want, fault, isErr, exceptions)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package xray_grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Prepares the outgoing context of a client call and reports whether the call should be traced
+func (o *options) startClientCall(ctx context.Context, method string) (context.Context, bool) {
+	if len(o.propagatedMetadata) > 0 {
+		ctx = propagateMetadata(ctx, o.propagatedMetadata)
+	}
+	ctx = propagateHop(ctx)
+
+	if tracingDisabled(ctx) {
+		return ctx, false
+	}
+
+	// A closed parent can not take new subsegments, continue on without tracing
+	if parent := xray.GetSegment(ctx); parent != nil && segmentClosed(parent) {
+		o.warnf("xray_grpc: segment %q was closed before calling %s, skipping subsegment", parent.Name, method)
+		return ctx, false
+	}
+
+	return ctx, true
+}
+
+// Used in place of a nil hostFromTarget, returns the host of target without scheme and port
+func hostWithoutPort(target string) string {
+	host, _ := splitTarget(target)
+	return host
+}
+
+// Splits a dial target into host and port, port is "" when target has none
+func splitTarget(target string) (host, port string) {
+	// Targets may follow the naming syntax scheme://authority/endpoint, e.g. dns:///my-service:3000
+	if i := strings.LastIndexByte(target, '/'); i >= 0 {
+		target = target[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		return host, port
+	}
+	return target, ""
+}
+
+// Returns the name of the subsegment for a call to method on cc
+func (o *options) subsegmentName(hostFromTarget func(string) string, cc *grpc.ClientConn, method string) string {
+	var name string
+	switch {
+	case o.fullMethodSubsegmentName:
+		name = method
+	case hostFromTarget == nil:
+		name = hostWithoutPort(cc.Target())
+	default:
+		// Retrieve the host (subsegment name) from the connection target
+		name = hostFromTarget(cc.Target())
+	}
+	return o.nameSanitizer(name)
+}
+
+// Appends the attempt number to name when the outgoing metadata of ctx numbers the call as a retry, see
+// WithAttemptNaming. X-Ray rejects parentheses in names, the attempt is appended as " attempt N".
+func (o *options) attemptName(ctx context.Context, name string) string {
+	if !o.attemptNaming {
+		return name
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	retry, err := strconv.Atoi(firstMetadataValue(md, retryAttemptMetadataKey))
+	if err != nil || retry <= 0 {
+		return name
+	}
+	// The first retry is the second attempt
+	return o.nameSanitizer(fmt.Sprintf("%s attempt %d", name, retry+1))
+}
+
+// Populates a freshly started client subsegment for a call to method on cc and injects the trace header into the
+// outgoing context, with the injector set with WithHeaderInjector if any. The returned CallOption sends the X-Ray
+// header in case an interceptor further down the chain drops it from the outgoing metadata, and must be passed
+// before the caller's options so it doesn't override their per-RPC credentials.
+func (o *options) beginClientSubsegment(ctx context.Context, seg *xray.Segment, cc *grpc.ClientConn, method string) (context.Context, grpc.CallOption) {
+	// Make the subsegment discoverable via SubsegmentIDsFromContext
+	trackSubsegment(ctx, seg.ID)
+
+	// TODO: Implement httptrace equivalent (DNS Lookup, etc)
+
+	seg.Lock()
+
+	// gRPC is always POST, unless overridden with WithHTTPMethod
+	seg.GetHTTP().GetRequest().Method = o.httpMethod
+	// Same as the server, the URL is the full method
+	seg.GetHTTP().GetRequest().URL = o.urlSanitizer(method)
+
+	// Populate Metadata for the gRPC server
+	var fallback grpc.CallOption = grpc.EmptyCallOption{}
+	downstream := downstreamHeader(ctx, seg)
+	if o.headerInjector == nil {
+		ctx = injectTraceHeader(ctx, seg)
+		fallback = grpc.PerRPCCredentials(traceHeaderCredentials{value: downstream.String()})
+	}
+
+	seg.Unlock()
+
+	// Outside the lock, the injector may use the subsegment
+	if o.headerInjector != nil {
+		ctx = o.headerInjector(ctx, downstream)
+	} else {
+		// What the server should continue from, to debug propagation mismatches
+		o.addMetadata(xraySegment{seg}, "xray.downstream_header", downstream.String())
+	}
+
+	o.annotatePackage(seg, method)
+	// Helps debugging port routing behind a mesh
+	if _, port := splitTarget(cc.Target()); port != "" {
+		o.addMetadata(xraySegment{seg}, "grpc.target_port", port)
+	}
+	if o.regionTagger != nil {
+		if local, remote, crossed := o.regionTagger(cc.Target()); crossed {
+			o.addAnnotation(xraySegment{seg}, "grpc.cross_region", true)
+			o.addAnnotation(xraySegment{seg}, "grpc.local_region", local)
+			o.addAnnotation(xraySegment{seg}, "grpc.remote_region", remote)
+		}
+	}
+	if o.backendCount != nil {
+		if n := o.backendCount(cc); n >= 0 {
+			o.addAnnotation(xraySegment{seg}, "grpc.backend_count", n)
+		}
+	}
+	if o.idempotencyAnnotation {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		o.addAnnotation(xraySegment{seg}, "grpc.idempotent", len(md.Get(idempotencyKeyMetadataKey)) > 0)
+	}
+
+	// The X-Ray header has no deadline field, record the budget grpc-go will send as grpc-timeout instead
+	if deadline, ok := ctx.Deadline(); ok {
+		o.addAnnotation(xraySegment{seg}, "grpc.timeout", encodeTimeout(time.Until(deadline)))
+	}
+
+	return ctx, fallback
+}
+
+// Records the outcome of a client call made with ctx on its subsegment, p is the peer captured with grpc.Peer. The
+// subsegment is not closed, and must be closed without the error since it is already recorded.
+func (o *options) endClientSubsegment(ctx context.Context, seg *xray.Segment, p *peer.Peer, err error) {
+	// Errors the filter doesn't count keep their status, without flagging the subsegment
+	o.recordOutcome(xraySegment{seg}, err, err == nil || o.clientErrorFilter == nil || o.clientErrorFilter(err))
+
+	o.addAnnotation(xraySegment{seg}, "grpc.tls", peerUsesTLS(p))
+	if isTransportError(err) {
+		o.addAnnotation(xraySegment{seg}, "grpc.transport_error", true)
+	}
+	o.recordDeadline(ctx, seg, err)
+}
@@ -0,0 +1,220 @@
+package xray_grpc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientParentClosed(t *testing.T) {
+	logger := &recordingLogger{}
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	root.Close(nil)
+
+	called := false
+	seg, err := invokeWith(NewGrpcXrayUnaryClientInterceptor(nil, WithLogger(logger)), ctx, newTestConn(t),
+		func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			called = true
+			return nil
+		})
+	if err != nil || !called {
+		t.Fatalf("call returned %v, invoked: %t, want it to go through", err, called)
+	}
+	if seg != nil {
+		t.Errorf("subsegment %q created under a closed segment", seg.Name)
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "was closed before calling") {
+		t.Errorf("logged %q, want a warning about the closed segment", logged)
+	}
+}
+
+func TestSubsegmentName(t *testing.T) {
+	tests := []struct {
+		name           string
+		hostFromTarget func(string) string
+		opts           []Option
+		want           string
+	}{
+		{"host of target", nil, nil, "my-service.my-namespace.local"},
+		{"hostFromTarget", GetDefaultHostFromTargetFunc("my-namespace.local"), nil, "my-service"},
+		{"full method", GetDefaultHostFromTargetFunc("my-namespace.local"), []Option{WithFullMethodSubsegmentName(true)}, testMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, err := invokeWith(NewGrpcXrayUnaryClientInterceptor(tt.hostFromTarget, tt.opts...), context.Background(), newTestConn(t), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.Name != tt.want {
+				t.Errorf("subsegment name = %q, want %q", seg.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientTimeoutAnnotation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	// The remaining budget is wall-clock whatever clock is configured
+	seg, err := invokeUnary(ctx, newTestConn(t), nil, WithClock(func() time.Time { return time.Unix(0, 0) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := annotations(seg)["grpc.timeout"].(string)
+	if d, err := decodeTimeout(value); err != nil || d <= time.Second || d > 1500*time.Millisecond {
+		t.Errorf("grpc.timeout = %q, want within (1S, 1500m]", value)
+	}
+
+	seg, err = invokeUnary(context.Background(), newTestConn(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoAnnotation(t, seg, "grpc.timeout")
+}
+
+func TestNilHostFromTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{testTarget, "my-service.my-namespace.local"},
+		{"dns:///my-service:3000", "my-service"},
+		{"my-service", "my-service"},
+		{"[::1]:3000", "::1"},
+	}
+	for _, tt := range tests {
+		seg, err := invokeWith(NewGrpcXrayUnaryClientInterceptor(nil), context.Background(), newTestConnTo(t, tt.target), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seg.Name != tt.want {
+			t.Errorf("target %q named the subsegment %q, want %q", tt.target, seg.Name, tt.want)
+		}
+	}
+}
+
+func TestClientErrorFilter(t *testing.T) {
+	notFound := status.Error(codes.NotFound, "cache miss")
+	unavailable := status.Error(codes.Unavailable, "backend down")
+	ignoreNotFound := WithClientErrorFilter(func(err error) bool { return status.Code(err) != codes.NotFound })
+	tests := []struct {
+		name       string
+		err        error
+		opts       []Option
+		wantStatus int
+		wantFlag   bool
+	}{
+		{"filtered", notFound, []Option{ignoreNotFound}, 404, false},
+		{"counted", unavailable, []Option{ignoreNotFound}, 503, true},
+		{"default", notFound, nil, 404, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := invokeUnary(context.Background(), newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+				return tt.err
+			}, tt.opts...)
+			if err != tt.err {
+				t.Fatalf("err = %v, want the invoker's", err)
+			}
+			code, fault, isError, _ := segmentStatus(sub)
+			sub.RLock()
+			exceptions := len(sub.GetCause().Exceptions)
+			sub.RUnlock()
+			if code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", code, tt.wantStatus)
+			}
+			if flagged := fault || isError || exceptions > 0; flagged != tt.wantFlag {
+				t.Errorf("fault %t, error %t, %d exceptions, want flagged: %t", fault, isError, exceptions, tt.wantFlag)
+			}
+		})
+	}
+}
+
+func TestTargetPortMetadata(t *testing.T) {
+	tests := []struct {
+		target string
+		want   interface{}
+	}{
+		{testTarget, "3000"},
+		{"[::1]:8443", "8443"},
+		{"my-service.my-namespace.local", nil},
+	}
+	for _, tt := range tests {
+		sub, _ := invokeUnary(context.Background(), newTestConnTo(t, tt.target), nil)
+		if got := metadataOf(sub)["grpc.target_port"]; got != tt.want {
+			t.Errorf("%s: grpc.target_port = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAttemptNaming(t *testing.T) {
+	cc := newTestConn(t)
+	first, _ := invokeUnary(context.Background(), cc, nil, WithAttemptNaming(true))
+	name := first.Name
+
+	// Like go-grpc-middleware's retry interceptor running before ours
+	for retry, want := range []string{name + " attempt 2", name + " attempt 3"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-retry-attempt", strconv.Itoa(retry+1))
+		sub, _ := invokeUnary(ctx, cc, nil, WithAttemptNaming(true))
+		if sub.Name != want {
+			t.Errorf("retry %d named %q, want %q", retry+1, sub.Name, want)
+		}
+		sub, _ = invokeUnary(ctx, cc, nil)
+		if sub.Name != name {
+			t.Errorf("retry %d named %q by default, want %q", retry+1, sub.Name, name)
+		}
+	}
+}
+
+func TestBackendCount(t *testing.T) {
+	cc := newTestConn(t)
+	var got *grpc.ClientConn
+	sub, _ := invokeUnary(context.Background(), cc, nil, WithBackendCount(func(cc *grpc.ClientConn) int {
+		got = cc
+		return 3
+	}))
+	if got != cc {
+		t.Error("accessor not given the connection of the call")
+	}
+	assertAnnotation(t, sub, "grpc.backend_count", 3)
+
+	// The accessor may not know the count
+	sub, _ = invokeUnary(context.Background(), cc, nil, WithBackendCount(func(*grpc.ClientConn) int { return -1 }))
+	assertNoAnnotation(t, sub, "grpc.backend_count")
+
+	sub, _ = invokeUnary(context.Background(), cc, nil)
+	assertNoAnnotation(t, sub, "grpc.backend_count")
+}
+
+func TestRegionTagger(t *testing.T) {
+	var targets []string
+	tagger := WithRegionTagger(func(target string) (string, string, bool) {
+		targets = append(targets, target)
+		remote := "eu-west-1"
+		if strings.HasPrefix(target, "remote.") {
+			remote = "us-east-1"
+		}
+		return "eu-west-1", remote, remote != "eu-west-1"
+	})
+
+	sub, _ := invokeUnary(context.Background(), newTestConnTo(t, "remote.orders.local:3000"), nil, tagger)
+	assertAnnotation(t, sub, "grpc.cross_region", true)
+	assertAnnotation(t, sub, "grpc.local_region", "eu-west-1")
+	assertAnnotation(t, sub, "grpc.remote_region", "us-east-1")
+	if len(targets) != 1 || targets[0] != "remote.orders.local:3000" {
+		t.Errorf("tagger called with %q, want the target of the connection", targets)
+	}
+
+	sub, _ = invokeUnary(context.Background(), newTestConn(t), nil, tagger)
+	for _, key := range []string{"grpc.cross_region", "grpc.local_region", "grpc.remote_region"} {
+		assertNoAnnotation(t, sub, key)
+	}
+}
@@ -0,0 +1,100 @@
+package xray_grpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Keeps the subsegments of failed client calls open for a short window, so a retry is recorded on the subsegment
+// of the first attempt instead of a new one
+type retryCoalescer struct {
+	window  time.Duration
+	mu      sync.Mutex
+	pending map[retryKey]*pendingRetry
+}
+
+type retryKey struct {
+	parent *xray.Segment
+	name   string
+	method string
+}
+
+type pendingRetry struct {
+	seg     *xray.Segment
+	retries int
+	timer   *time.Timer
+}
+
+// Removes and returns the subsegment held open for k, if its window has not elapsed yet
+func (c *retryCoalescer) take(k retryKey) *pendingRetry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[k]
+	// The window elapsed and the subsegment is being closed
+	if !ok || !p.timer.Stop() {
+		return nil
+	}
+	delete(c.pending, k)
+	return p
+}
+
+// Holds the subsegment of a failed attempt open, it is closed when no retry starts within the window
+func (c *retryCoalescer) hold(k retryKey, p *pendingRetry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.timer = time.AfterFunc(c.window, func() {
+		c.mu.Lock()
+		if c.pending[k] == p {
+			delete(c.pending, k)
+		}
+		c.mu.Unlock()
+		p.seg.Close(nil)
+	})
+	c.pending[k] = p
+}
+
+// Behaves like xray.Capture, except that fn runs on the held subsegment when the call is a retry of a failed attempt
+func (o *options) captureCoalesced(ctx context.Context, name, method string, fn func(context.Context) error) (err error) {
+	parent := xray.GetSegment(ctx)
+	if parent == nil {
+		return xray.Capture(ctx, name, fn)
+	}
+
+	k := retryKey{parent: parent, name: name, method: method}
+	p := o.retryCoalescer.take(k)
+	if p != nil {
+		p.retries++
+		// The flags reflect the latest attempt, the exceptions of earlier ones are kept as the history of the call
+		p.seg.Lock()
+		p.seg.Fault, p.seg.Error, p.seg.Throttle = false, false, false
+		p.seg.Unlock()
+		ctx = context.WithValue(ctx, xray.ContextKey, p.seg)
+		o.addAnnotation(xraySegment{p.seg}, "grpc.retry_count", p.retries)
+	} else {
+		var seg *xray.Segment
+		ctx, seg = xray.BeginSubsegment(ctx, name)
+		if seg == nil {
+			return fn(ctx)
+		}
+		p = &pendingRetry{seg: seg}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			p.seg.Close(exceptionFormatter(p.seg).Panicf("%v", r))
+			panic(r)
+		}
+	}()
+
+	// The outcome of the latest attempt is recorded by fn
+	err = fn(ctx)
+	if err == nil {
+		p.seg.Close(nil)
+		return nil
+	}
+	o.retryCoalescer.hold(k, p)
+	return err
+}
@@ -0,0 +1,51 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryCoalescing(t *testing.T) {
+	interceptor := NewGrpcXrayUnaryClientInterceptor(nil, WithRetryCoalescing(time.Minute))
+	cc := newTestConn(t)
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+
+	first, err := invokeWith(interceptor, ctx, cc, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "try again")
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("err = %v, want Unavailable", err)
+	}
+	if _, fault, _, _ := segmentStatus(first); !fault || segmentClosed(first) {
+		t.Fatalf("failed attempt: fault %t, closed %t, want an open faulted subsegment", fault, segmentClosed(first))
+	}
+
+	retry, err := invokeWith(interceptor, ctx, cc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry != first {
+		t.Fatalf("retry recorded on subsegment %s, want the one of the first attempt %s", retry.ID, first.ID)
+	}
+	if !segmentClosed(first) {
+		t.Error("subsegment left open after the retry succeeded")
+	}
+	assertAnnotation(t, first, "grpc.retry_count", 1)
+	if code, fault, isErr, throttle := segmentStatus(first); code != 200 || fault || isErr || throttle {
+		t.Errorf("status %d, fault %t, error %t, throttle %t, want the successful retry's", code, fault, isErr, throttle)
+	}
+	// The failed attempt stays visible
+	first.RLock()
+	exceptions := len(first.GetCause().Exceptions)
+	first.RUnlock()
+	if exceptions != 1 {
+		t.Errorf("%d exceptions, want the one of the failed attempt", exceptions)
+	}
+}
@@ -0,0 +1,21 @@
+package xray_grpc
+
+import (
+	"context"
+)
+
+type disableTracingKey struct{}
+
+// Returns a copy of ctx for which the interceptors of this package don't create (sub)segments, e.g. for a handler
+// that recursively calls its own service and wants to avoid runaway nested subsegments:
+//
+// resp, err := client.Get(xray_grpc.DisableTracing(ctx), req)
+//
+func DisableTracing(ctx context.Context) context.Context {
+	return context.WithValue(ctx, disableTracingKey{}, true)
+}
+
+func tracingDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(disableTracingKey{}).(bool)
+	return disabled
+}
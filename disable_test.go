@@ -0,0 +1,39 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+)
+
+func TestDisableTracing(t *testing.T) {
+	ctx := DisableTracing(context.Background())
+
+	called := false
+	seg, _, err := serveUnary(ctx, nil, func(context.Context, interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if err != nil || !called {
+		t.Fatalf("handler called: %t, err = %v, want it to run untraced", called, err)
+	}
+	if seg != nil {
+		t.Errorf("segment %q created with tracing disabled", seg.Name)
+	}
+
+	ctx, root := xray.BeginSegment(ctx, "test")
+	defer root.Close(nil)
+	called = false
+	sub, err := invokeUnary(ctx, newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Fatalf("invoker called: %t, err = %v, want it to run untraced", called, err)
+	}
+	if sub != nil {
+		t.Errorf("subsegment %q created with tracing disabled", sub.Name)
+	}
+}
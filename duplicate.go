@@ -0,0 +1,53 @@
+package xray_grpc
+
+import (
+	"context"
+	"sync"
+)
+
+type duplicateMarkerKey struct{}
+
+// Whether the handler marked the request it is handling as a duplicate
+type duplicateMarker struct {
+	sync.Mutex
+	duplicate bool
+}
+
+func withDuplicateMarker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, duplicateMarkerKey{}, &duplicateMarker{})
+}
+
+// Reports whether MarkDuplicate was called with ctx or a context derived from it
+func markedDuplicate(ctx context.Context) bool {
+	m, ok := ctx.Value(duplicateMarkerKey{}).(*duplicateMarker)
+	if !ok {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.duplicate
+}
+
+// Marks the request being handled as a replay of one that was already processed, e.g. a retry carrying an
+// idempotency key that was seen before, recorded as the grpc.duplicate annotation once the handler returned. Makes
+// retry storms visible in traces. ctx must be (or derive from) the context passed to a handler by
+// NewGrpcXrayUnaryServerInterceptor or NewGrpcXrayStreamServerInterceptor, otherwise the call has no effect.
+// Usage:
+//
+// func (s *server) Pay(ctx context.Context, req *pb.PayRequest) (*pb.PayResponse, error) {
+//     if resp, ok := s.processed(req.IdempotencyKey); ok {
+//         xray_grpc.MarkDuplicate(ctx)
+//         return resp, nil
+//     }
+//     ...
+// }
+//
+func MarkDuplicate(ctx context.Context) {
+	m, ok := ctx.Value(duplicateMarkerKey{}).(*duplicateMarker)
+	if !ok {
+		return
+	}
+	m.Lock()
+	m.duplicate = true
+	m.Unlock()
+}
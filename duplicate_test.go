@@ -0,0 +1,42 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMarkDuplicate(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		// Contexts derived from the handler's are marked too
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		MarkDuplicate(ctx)
+		return "cached response", nil
+	})
+	assertAnnotation(t, seg, "grpc.duplicate", true)
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.duplicate")
+
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"))
+	ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(_ interface{}, stream grpc.ServerStream) error {
+		seg = xray.GetSegment(stream.Context())
+		MarkDuplicate(stream.Context())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnnotation(t, seg, "grpc.duplicate", true)
+
+	// Outside a handler there is nothing to mark
+	MarkDuplicate(context.Background())
+	if markedDuplicate(context.Background()) {
+		t.Error("context without a marker reported as duplicate")
+	}
+}
@@ -0,0 +1,63 @@
+package xray_grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Emitter used by WithShadowMode, drops every segment instead of sending it to the daemon
+type discardEmitter struct{}
+
+func (discardEmitter) Emit(*xray.Segment) {}
+
+func (discardEmitter) RefreshEmitterWithAddress(*net.UDPAddr) {}
+
+type shadowModeKey struct{}
+
+// Marks ctx as handling a call traced in shadow mode, see WithShadowMode
+func withShadowMode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shadowModeKey{}, true)
+}
+
+// Reports whether ctx handles a call traced in shadow mode
+func inShadowMode(ctx context.Context) bool {
+	shadow, _ := ctx.Value(shadowModeKey{}).(bool)
+	return shadow
+}
+
+// Returns an emitter sending segments to the daemon at addr, for WithDaemonAddress
+func newDaemonEmitter(addr string) (xray.Emitter, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daemon address %q: %w", addr, err)
+	}
+	emitter, err := xray.NewDefaultEmitter(raddr)
+	if err != nil {
+		return nil, err
+	}
+	return emitter, nil
+}
+
+// Emitters created by the interceptors (see WithDaemonAddress), which Flush must reach without a context
+var createdEmitters struct {
+	sync.Mutex
+	list []xray.Emitter
+}
+
+// Makes e, created for an interceptor, flushed by Flush
+func registerEmitter(e xray.Emitter) {
+	createdEmitters.Lock()
+	createdEmitters.list = append(createdEmitters.list, e)
+	createdEmitters.Unlock()
+}
+
+// Returns the emitters registered with registerEmitter
+func registeredEmitters() []xray.Emitter {
+	createdEmitters.Lock()
+	defer createdEmitters.Unlock()
+	return append([]xray.Emitter(nil), createdEmitters.list...)
+}
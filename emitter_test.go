@@ -0,0 +1,99 @@
+package xray_grpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestShadowMode(t *testing.T) {
+	for _, shadow := range []bool{true, false} {
+		ctx, emitter := withRecordingEmitter(context.Background())
+		seg, _, err := serveUnary(ctx, nil, nil, WithShadowMode(shadow))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Recorded as usual
+		if !segmentClosed(seg) {
+			t.Errorf("WithShadowMode(%t): segment left open", shadow)
+		}
+		if code, _, _, _ := segmentStatus(seg); code != 200 {
+			t.Errorf("WithShadowMode(%t): status = %d, want 200", shadow, code)
+		}
+
+		want := 1
+		if shadow {
+			want = 0
+		}
+		if got := len(emitter.emitted()); got != want {
+			t.Errorf("WithShadowMode(%t): %d segments reached the emitter, want %d", shadow, got, want)
+		}
+	}
+}
+
+func TestDaemonAddress(t *testing.T) {
+	daemon := startFakeDaemon(t)
+	seg, _, err := serveUnary(context.Background(), nil, nil, WithDaemonAddress(daemon.addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc := daemon.receive(t); doc["id"] != seg.ID || doc["trace_id"] != seg.TraceID {
+		t.Errorf("daemon received segment %v of trace %v, want %s of %s", doc["id"], doc["trace_id"], seg.ID, seg.TraceID)
+	}
+	for _, s := range testEmitter.emitted() {
+		if s == seg {
+			t.Error("segment also sent to the globally configured emitter")
+		}
+	}
+}
+
+func TestDaemonAddressInvalid(t *testing.T) {
+	logger := &recordingLogger{}
+	seg, _, err := serveUnary(context.Background(), nil, nil, WithLogger(logger), WithDaemonAddress("not an address"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !segmentClosed(seg) {
+		t.Error("segment left open")
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "invalid daemon address") {
+		t.Errorf("logged %q, want the invalid address reported", logged)
+	}
+}
+
+func TestShadowModeDownstreamHeader(t *testing.T) {
+	cc := newTestConn(t)
+	for _, shadow := range []bool{true, false} {
+		var sent string
+		_, _, err := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			return invokeUnary(ctx, cc, func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+				md, _ := metadata.FromOutgoingContext(ctx)
+				sent = firstMetadataValue(md, xray.TraceIDHeaderKey)
+				return nil
+			})
+		}, WithShadowMode(shadow))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := header.Sampled
+		if shadow {
+			want = header.NotSampled
+		}
+		if h := header.FromString(sent); h.SamplingDecision != want {
+			t.Errorf("WithShadowMode(%t): sent %q, want sampling decision %q", shadow, sent, want)
+		}
+
+		// A downstream edge server keeps the caller's decision
+		edge := NewGrpcXrayEdgeServerInterceptor(xray.NewFixedSegmentNamer("downstream"))
+		seg, _, _ := serveWith(edge, context.Background(), metadata.Pairs(xray.TraceIDHeaderKey, sent), nil)
+		if seg.Sampled == shadow {
+			t.Errorf("WithShadowMode(%t): downstream segment sampled: %t", shadow, seg.Sampled)
+		}
+	}
+}
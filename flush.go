@@ -0,0 +1,60 @@
+package xray_grpc
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Implemented by xray.Emitter implementations that buffer segments before sending them to the daemon
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flushes the emitters this package can reach: only emitters configured via xray.ContextWithConfig (found in ctx)
+// and those created by the interceptors for WithDaemonAddress are flushed, the SDK does not expose an emitter set
+// with xray.Configure. Emitters that implement Flusher send the segments they buffered, waiting at most until ctx
+// is done. Call it from graceful shutdown, after the gRPC server has stopped (e.g. grpc.Server.GracefulStop) so
+// that in-flight segments are closed. The SDK's default emitter sends every segment as soon as it is closed, in
+// which case there is nothing to flush. Every emitter is flushed, the first error is returned.
+// Usage:
+//
+// s.GracefulStop()
+// if err := xray_grpc.Flush(ctx); err != nil {
+//     log.Printf("failed to flush segments: %v", err)
+// }
+//
+func Flush(ctx context.Context) error {
+	emitters := registeredEmitters()
+	if cfg := xray.GetRecorder(ctx); cfg != nil && cfg.Emitter != nil {
+		emitters = append([]xray.Emitter{cfg.Emitter}, emitters...)
+	}
+
+	var first error
+	flushed := make([]xray.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		f, ok := e.(Flusher)
+		if !ok || containsEmitter(flushed, e) {
+			continue
+		}
+		flushed = append(flushed, e)
+		if err := f.Flush(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Reports whether emitters holds e, never for emitters whose type can't be compared
+func containsEmitter(emitters []xray.Emitter, e xray.Emitter) bool {
+	if !reflect.TypeOf(e).Comparable() {
+		return false
+	}
+	for _, other := range emitters {
+		if other == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Buffers nothing, but records being flushed
+type flushingEmitter struct {
+	recordingEmitter
+	flushed int
+	err     error
+}
+
+func (e *flushingEmitter) Flush(context.Context) error {
+	e.flushed++
+	return e.err
+}
+
+func TestFlush(t *testing.T) {
+	e := &flushingEmitter{}
+	ctx := contextWithConfig(context.Background(), func(cfg *xray.Config) { cfg.Emitter = e })
+	if err := Flush(ctx); err != nil || e.flushed != 1 {
+		t.Errorf("Flush() = %v after flushing %d times, want nil after flushing once", err, e.flushed)
+	}
+
+	e.err = errors.New("daemon unreachable")
+	if err := Flush(ctx); err != e.err {
+		t.Errorf("Flush() = %v, want the emitter's error", err)
+	}
+
+	ctx, _ = withRecordingEmitter(context.Background())
+	if err := Flush(ctx); err != nil {
+		t.Errorf("Flush() = %v with an emitter that doesn't buffer, want nil", err)
+	}
+	if err := Flush(context.Background()); err != nil {
+		t.Errorf("Flush() = %v without a configuration, want nil", err)
+	}
+}
+
+func TestFlushCreatedEmitters(t *testing.T) {
+	defer func(list []xray.Emitter) {
+		createdEmitters.Lock()
+		createdEmitters.list = list
+		createdEmitters.Unlock()
+	}(registeredEmitters())
+
+	// Emitters created for WithDaemonAddress are registered
+	before := len(registeredEmitters())
+	o := newServerOptions([]Option{WithDaemonAddress("127.0.0.1:2000")})
+	if got := registeredEmitters(); len(got) != before+1 || got[before] != o.emitter {
+		t.Fatalf("registered %d emitters, want the one created for the interceptor", len(got)-before)
+	}
+
+	e := &flushingEmitter{}
+	registerEmitter(e)
+	// As with xray.Configure, nothing in the context
+	if err := Flush(context.Background()); err != nil || e.flushed != 1 {
+		t.Errorf("Flush() = %v after flushing %d times, want nil after flushing once", err, e.flushed)
+	}
+
+	// Configured in the context too, still flushed once
+	ctx := contextWithConfig(context.Background(), func(cfg *xray.Config) { cfg.Emitter = e })
+	if err := Flush(ctx); err != nil || e.flushed != 2 {
+		t.Errorf("Flush() = %v after flushing %d times, want a single flush", err, e.flushed-1)
+	}
+
+	// Every emitter is flushed, the first error is returned
+	failing := &flushingEmitter{err: errors.New("daemon unreachable")}
+	ctx = contextWithConfig(context.Background(), func(cfg *xray.Config) { cfg.Emitter = failing })
+	if err := Flush(ctx); err != failing.err || e.flushed != 3 {
+		t.Errorf("Flush() = %v after flushing %d times, want the first error after flushing all", err, e.flushed-2)
+	}
+}
@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/aws/aws-xray-sdk-go v1.2.0
+	github.com/golang/protobuf v1.4.2
 	google.golang.org/grpc v1.35.0
 )
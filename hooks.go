@@ -0,0 +1,11 @@
+package xray_grpc
+
+// Runs the hook set with the option named option, a panic is logged instead of breaking the call
+func (o *options) runHook(option string, hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			o.warnf("xray_grpc: %s hook panicked: %v", option, r)
+		}
+	}()
+	hook()
+}
@@ -0,0 +1,87 @@
+package xray_grpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestOnSegmentStart(t *testing.T) {
+	calls := 0
+	seg, _, err := serveUnary(context.Background(), nil, nil, WithOnSegmentStart(func(ctx context.Context, seg *xray.Segment) {
+		calls++
+		if xray.GetSegment(ctx) != seg {
+			t.Error("hook context doesn't carry the segment")
+		}
+		seg.AddAnnotation("tenant", "acme")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("hook called %d times, want once", calls)
+	}
+	assertAnnotation(t, seg, "tenant", "acme")
+
+	logger := &recordingLogger{}
+	called := false
+	_, resp, err := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		called = true
+		return "response", nil
+	}, WithLogger(logger), WithOnSegmentStart(func(context.Context, *xray.Segment) { panic("enrichment failed") }))
+	if err != nil || resp != "response" || !called {
+		t.Errorf("panicking hook broke the call: %v, %v", resp, err)
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "WithOnSegmentStart") {
+		t.Errorf("logged %q, want the panic", logged)
+	}
+}
+
+func TestOnSegmentEnd(t *testing.T) {
+	failure := status.Error(codes.NotFound, "no such order")
+	var got error
+	var closed bool
+	var code int
+	seg, _, err := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, failure
+	}, WithOnSegmentEnd(func(ctx context.Context, seg *xray.Segment, err error) {
+		got = err
+		closed = segmentClosed(seg)
+		code, _, _, _ = segmentStatus(seg)
+		seg.AddAnnotation("order.missing", status.Code(err) == codes.NotFound)
+	}))
+	if err != failure || got != failure {
+		t.Fatalf("hook got %v, call returned %v, want the handler error", got, err)
+	}
+	if closed || code != 404 {
+		t.Errorf("hook saw closed: %t, status %d, want an open segment with the outcome recorded", closed, code)
+	}
+	assertAnnotation(t, seg, "order.missing", true)
+
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithOnSegmentEnd(func(_ context.Context, _ *xray.Segment, err error) {
+		got = err
+	}))
+	ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+	err = interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(interface{}, grpc.ServerStream) error {
+		return failure
+	})
+	if err != failure || got != failure {
+		t.Errorf("stream hook got %v, call returned %v, want the handler error", got, err)
+	}
+
+	logger := &recordingLogger{}
+	seg, _, err = serveUnary(context.Background(), nil, nil, WithLogger(logger),
+		WithOnSegmentEnd(func(context.Context, *xray.Segment, error) { panic("annotation failed") }))
+	if err != nil || !segmentClosed(seg) {
+		t.Errorf("panicking hook broke the call: %v, closed: %t", err, segmentClosed(seg))
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "WithOnSegmentEnd") {
+		t.Errorf("logged %q, want the panic", logged)
+	}
+}
@@ -0,0 +1,35 @@
+package xray_grpc
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key carrying the number of services a call went through before reaching the server
+const hopMetadataKey = "x-trace-hop"
+
+type hopKey struct{}
+
+// Reads the hop count of a server call from md, 0 when missing or invalid, and stores the count downstream calls
+// made while handling it forward
+func withHop(ctx context.Context, md metadata.MD) (context.Context, int) {
+	hop, err := strconv.Atoi(firstMetadataValue(md, hopMetadataKey))
+	if err != nil || hop < 0 {
+		hop = 0
+	}
+	return context.WithValue(ctx, hopKey{}, hop+1), hop
+}
+
+// Forwards the hop count stored by withHop to the outgoing metadata of ctx, unless it is already set
+func propagateHop(ctx context.Context) context.Context {
+	hop, ok := ctx.Value(hopKey{}).(int)
+	if !ok {
+		return ctx
+	}
+	if out, _ := metadata.FromOutgoingContext(ctx); len(out.Get(hopMetadataKey)) > 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, hopMetadataKey, strconv.Itoa(hop))
+}
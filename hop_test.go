@@ -0,0 +1,50 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHopCount(t *testing.T) {
+	cc := newTestConn(t)
+	// Each service of the chain handles the call and forwards the metadata the client interceptor sent
+	md := metadata.MD{}
+	for want := 0; want < 3; want++ {
+		var out metadata.MD
+		seg, _, err := serveUnary(context.Background(), md, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			_, err := invokeUnary(ctx, cc, func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+				out, _ = metadata.FromOutgoingContext(ctx)
+				return nil
+			})
+			return nil, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAnnotation(t, seg, "grpc.hop", want)
+		md = metadata.MD{hopMetadataKey: out.Get(hopMetadataKey)}
+	}
+}
+
+func TestHopCountInvalid(t *testing.T) {
+	for _, value := range []string{"-1", "many"} {
+		seg, _, _ := serveUnary(context.Background(), metadata.Pairs(hopMetadataKey, value), nil)
+		assertAnnotation(t, seg, "grpc.hop", 0)
+	}
+
+	// Calls made outside of a server call carry no hop count
+	var out metadata.MD
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	invokeUnary(ctx, newTestConn(t), func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		out, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	})
+	if got := out.Get(hopMetadataKey); len(got) != 0 {
+		t.Errorf("hop count %q sent, want none", got)
+	}
+}
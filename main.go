@@ -5,14 +5,11 @@ package xray_grpc
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 
-	"github.com/aws/aws-xray-sdk-go/header"
 	"github.com/aws/aws-xray-sdk-go/xray"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 )
 
@@ -23,7 +20,9 @@ const (
 
 // Returns a UnaryClientInterceptor that supports populating gRPC metadata with AWS X-Ray information.
 // Parameter hostFromTarget allows you to translate the grpc.ClientConn target into your preferred outbound
-// server name. DNS Information, URL, gRPC error codes, and Content Length are currently not supported.
+// server name, when nil the host of the target (without port) is used. gRPC codes are recorded as the closest
+// HTTP status. DNS Information is currently not supported, Content Length requires NewStatsHandler. Behaviour can
+// be customised with opts.
 // Usage:
 //
 // customHostFromTarget = func (target string) string {
@@ -35,14 +34,21 @@ const (
 //                        grpc.WithInsecure(),
 //                        grpc.WithUnaryInterceptor(xray_grpc.NewGrpcXrayUnaryClientInterceptor(customHostFromTarget)))
 //
-func NewGrpcXrayUnaryClientInterceptor(hostFromTarget func(string) string) grpc.UnaryClientInterceptor {
+func NewGrpcXrayUnaryClientInterceptor(hostFromTarget func(string) string, opts ...Option) grpc.UnaryClientInterceptor {
+	return newOptions(opts).unaryClientInterceptor(hostFromTarget)
+}
+
+// Builds the interceptor returned by NewGrpcXrayUnaryClientInterceptor from resolved options
+func (o *options) unaryClientInterceptor(hostFromTarget func(string) string) grpc.UnaryClientInterceptor {
 	return func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 
-		// Retrieve the host (subsegment name) from the connection target
-		host := hostFromTarget(cc.Target())
+		ctx, trace := o.startClientCall(ctx, method)
+		if !trace {
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}
 
 		// Copied from X-Ray SDK
-		err := xray.Capture(ctx, host, func(ctx context.Context) error {
+		capture := func(ctx context.Context) error {
 			seg := xray.GetSegment(ctx)
 
 			// If no segment is found, continue on
@@ -50,108 +56,183 @@ func NewGrpcXrayUnaryClientInterceptor(hostFromTarget func(string) string) grpc.
 				return invoker(ctx, method, req, resp, cc, opts...)
 			}
 
-			// TODO: Implement httptrace equivalent (DNS Lookup, etc)
+			ctx, fallback := o.beginClientSubsegment(ctx, seg, cc, method)
 
-			seg.Lock()
+			annotate := o.sampleAnnotations()
+			if annotate && o.requestAnnotator != nil {
+				o.capAnnotations(xraySegment{seg}, func() { o.requestAnnotator(ctx, seg, req) })
+			}
 
-			// gRPC is always POST
-			seg.GetHTTP().GetRequest().Method = GrpcMethod
-			// TODO: Populate URL
+			// Lets a stats handler from NewStatsHandler report what it observed on the wire
+			ctx, wire := withWireStats(ctx, o.now)
 
-			// Populate Metadata for the gRPC server, see https://github.com/grpc/grpc-go/blob/master/Documentation/grpc-metadata.md
-			ctx = metadata.AppendToOutgoingContext(ctx, xray.TraceIDHeaderKey, seg.DownstreamHeader().String())
+			// Capture the peer so the transport security can be recorded once the call completes
+			p := &peer.Peer{}
+			err := invoker(ctx, method, req, resp, cc, append(append([]grpc.CallOption{fallback}, opts...), grpc.Peer(p))...)
+			o.endClientSubsegment(ctx, seg, p, err)
+			// Content Length is only known when a stats handler measured the call
+			if snap, ok := wire.snapshot(); ok {
+				o.recordWireStats(seg, snap, true)
+			}
 
-			seg.Unlock()
+			if o.messageCounts {
+				// Unary calls always send one request, a response is only received on success
+				o.addAnnotation(xraySegment{seg}, "grpc.sent_count", 1)
+				o.addAnnotation(xraySegment{seg}, "grpc.recv_count", btoi(err == nil))
+			}
 
-			err := invoker(ctx, method, req, resp, cc, opts...)
-			// Naive Status Codes
-			seg.Lock()
-			if err != nil {
-				seg.GetHTTP().GetResponse().Status = 400
-			} else {
-				seg.GetHTTP().GetResponse().Status = 200
+			if annotate && o.responseAnnotator != nil {
+				o.capAnnotations(xraySegment{seg}, func() { o.responseAnnotator(ctx, seg, resp, err) })
 			}
-			// TODO: Populate Content Length
-			seg.Unlock()
 
 			return err
-		})
+		}
 
+		name := o.subsegmentName(hostFromTarget, cc, method)
+		if o.retryCoalescer != nil {
+			return o.captureCoalesced(ctx, name, method, capture)
+		}
+		name = o.attemptName(ctx, name)
+
+		// The error is recorded by capture, closing the subsegment with it would flag every error as a fault
+		var err error
+		xray.Capture(ctx, name, func(ctx context.Context) error {
+			err = capture(ctx)
+			return nil
+		})
 		return err
 	}
 }
 
 // Returns a UnaryServerInterceptor that supports reading gRPC metadata that contains AWS X-Ray information.
-// Intended to recieve requests from a gRPC client that uses NewGrpcXrayUnaryClientInterceptor. Currently only
-// supports NewFixedSegmentNamer for parameter sn. Populating URL, gRPC error codes, and Content Length in segments
-// are currently not supported.
+// Intended to recieve requests from a gRPC client that uses NewGrpcXrayUnaryClientInterceptor. Parameter sn is
+// given the :authority of the request, so xray.NewDynamicSegmentNamer works as for HTTP. gRPC codes are recorded as
+// the closest HTTP status, Content Length requires NewStatsHandler. Behaviour can be customised with opts. The
+// grpc-encoding of requests is recorded as grpc.encoding metadata, but requests compressed with an encoding the
+// server has no decompressor for are rejected by grpc-go with Unimplemented before any interceptor runs, and are
+// only traced by the stats handler returned by NewStatsHandler with WithRejectedCalls.
 // Usage:
 //
 // s := grpc.NewServer(grpc.UnaryInterceptor(xray_grpc.NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("my-service"))))
 //
-func NewGrpcXrayUnaryServerInterceptor(sn xray.SegmentNamer) grpc.UnaryServerInterceptor {
+func NewGrpcXrayUnaryServerInterceptor(sn xray.SegmentNamer, opts ...Option) grpc.UnaryServerInterceptor {
+	return newServerOptions(opts).unaryServerInterceptor(sn)
+}
+
+// Builds the interceptor returned by NewGrpcXrayUnaryServerInterceptor from resolved options
+func (o *options) unaryServerInterceptor(sn xray.SegmentNamer) grpc.UnaryServerInterceptor {
 	return grpc.UnaryServerInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 
-		// Only supports NewFixedSegmentNamer
-		name := sn.Name("only NewFixedSegmentNamer is supported")
+		// On the clock set with WithClock, unlike the start time the SDK records
+		start := o.now()
+		ctx, seg, err := o.beginServerSegment(ctx, sn, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if seg == nil {
+			return handler(ctx, req)
+		}
+		o.addAnnotation(xraySegment{seg}, "grpc.method_type", methodType(false, false))
+		if o.traceTrailers {
+			// Sent with the status, whatever the handler returns
+			if err := grpc.SetTrailer(ctx, traceTrailer(seg)); err != nil {
+				o.warnf("xray_grpc: %v", err)
+			}
+		}
+		// With a stats handler from NewStatsHandler, wait for the response to be sent to record its size
+		if wire := wireStatsFromContext(ctx); wire != nil && !o.synchronousEmit {
+			defer wire.closeAfterEnd(o, seg)
+		} else {
+			defer closeServerSegment(seg)
+		}
 
-		// See https://github.com/grpc/grpc-go/blob/master/Documentation/grpc-metadata.md
-		md, ok := metadata.FromIncomingContext(ctx)
-		if !ok {
-			return nil, errors.New("unable to read metadata")
+		annotate := o.sampleAnnotations()
+		if annotate && o.requestAnnotator != nil {
+			o.capAnnotations(xraySegment{seg}, func() { o.requestAnnotator(ctx, seg, req) })
 		}
 
-		traceString := ""
-		if traceHeaderValueList, ok := md[xray.TraceIDHeaderKey]; ok {
-			// Assume Metadata Key only has one value
-			if len(traceHeaderValueList) > 0 {
-				traceString = traceHeaderValueList[0]
-			}
+		if o.captureValidation {
+			captureValidation(ctx, req)
 		}
-		traceHeader := header.FromString(traceString)
 
-		// Copy Segment creation from X-Ray SDK: https://github.com/aws/aws-xray-sdk-go/blob/master/xray/segment.go
-		ctx, seg := xray.NewSegmentFromHeader(ctx, name, nil, traceHeader)
-		defer seg.Close(nil)
+		var appStatus *appStatusRecorder
+		if stream := grpc.ServerTransportStreamFromContext(ctx); stream != nil && o.appStatusHeader != "" {
+			appStatus = &appStatusRecorder{key: o.appStatusHeader}
+			ctx = grpc.NewContextWithServerTransportStream(ctx, &appStatusTransportStream{stream, appStatus})
+		}
 
-		seg.Lock()
+		// A pre-handler rejecting the call ends it with its error
+		var resp interface{}
+		if o.preHandler != nil {
+			err = o.preHandler(ctx, seg, info)
+		}
+		if err == nil {
+			// Handle Request
+			resp, err = handler(ctx, req)
+		}
 
-		ClientIP := ""
-		p, ok := peer.FromContext(ctx)
-		if ok {
-			ClientIP = p.Addr.String()
+		if !o.endServerSegment(ctx, seg, info.FullMethod, start, err) {
+			return resp, o.serverError(seg, err)
 		}
 
-		reqData := &xray.RequestData{
-			Method:    GrpcMethod,
-			URL:       info.FullMethod,
-			ClientIP:  ClientIP,
-			UserAgent: CustomUserAgent,
+		if o.messageCounts {
+			// Unary calls always receive one request, a response is only sent on success
+			o.addAnnotation(xraySegment{seg}, "grpc.recv_count", 1)
+			o.addAnnotation(xraySegment{seg}, "grpc.sent_count", btoi(err == nil))
+		}
+		if o.subsegmentCount {
+			o.addAnnotation(xraySegment{seg}, "grpc.subsegment_count", trackedSubsegments(ctx))
 		}
 
-		seg.GetHTTP().Request = reqData
+		if appStatus != nil {
+			appStatus.record(o, seg)
+		}
 
-		// Handle Request
-		seg.Unlock()
-		resp, err := handler(ctx, req)
-		seg.Lock()
+		if o.emptyResponseAnnotation && err == nil && isNilMessage(resp) {
+			o.addAnnotation(xraySegment{seg}, "grpc.empty_response", true)
+		}
 
-		// Naive Status Codes
-		if err != nil {
-			seg.GetHTTP().GetResponse().Status = 400
-		} else {
-			seg.GetHTTP().GetResponse().Status = 200
+		if annotate && o.responseAnnotator != nil {
+			o.capAnnotations(xraySegment{seg}, func() { o.responseAnnotator(ctx, seg, resp, err) })
+		}
+		if o.onSegmentEnd != nil {
+			o.runHook("WithOnSegmentEnd", func() { o.onSegmentEnd(ctx, seg, err) })
 		}
-		// TODO: Populate Content Length
-		seg.Unlock()
 
-		return resp, err
+		return resp, o.serverError(seg, err)
 	})
 }
 
+// Returns a UnaryServerInterceptor for services at the edge of a trace (e.g. an ingress gateway). It behaves like
+// NewGrpcXrayUnaryServerInterceptor, but when the incoming trace header carries no sampling decision the decision
+// is made by the configured X-Ray sampling strategy, matching rules on the :authority host, the full method as URL
+// path and GrpcMethod (or the WithHTTPMethod override) as HTTP method. A new trace id is generated when the caller
+// did not send one.
+// Usage:
+//
+// s := grpc.NewServer(grpc.UnaryInterceptor(xray_grpc.NewGrpcXrayEdgeServerInterceptor(xray.NewFixedSegmentNamer("my-gateway"))))
+//
+func NewGrpcXrayEdgeServerInterceptor(sn xray.SegmentNamer, opts ...Option) grpc.UnaryServerInterceptor {
+	return NewGrpcXrayUnaryServerInterceptor(sn, append([]Option{withEdge()}, opts...)...)
+}
+
 func GetDefaultHostFromTargetFunc(namespace string) func(string) string {
 	return func(target string) string {
 		withoutPort := target[:strings.IndexByte(target, ':')]
 		return strings.ReplaceAll(withoutPort, fmt.Sprintf(".%s", namespace), "")
 	}
 }
+
+// Returns a hostFromTarget function that applies funcs from left to right, each receiving the result of the
+// previous one. Useful to chain namespace stripping with custom rewrites:
+//
+// hostFromTarget := xray_grpc.ComposeHostFromTarget(xray_grpc.GetDefaultHostFromTargetFunc("my-namespace.local"), strings.ToUpper)
+//
+func ComposeHostFromTarget(funcs ...func(string) string) func(string) string {
+	return func(target string) string {
+		for _, fn := range funcs {
+			target = fn(target)
+		}
+		return target
+	}
+}
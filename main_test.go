@@ -0,0 +1,468 @@
+package xray_grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/aws/aws-xray-sdk-go/xraylog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+const (
+	testMethod = "/test.Service/Method"
+	testTarget = "my-service.my-namespace.local:3000"
+)
+
+// Samples every segment, so tests don't depend on the reservoir of the default strategy
+type sampleAll struct{}
+
+func (sampleAll) ShouldTrace(*sampling.Request) *sampling.Decision {
+	return &sampling.Decision{Sample: true}
+}
+
+// Makes a fixed decision, keeping the requests it was asked about
+type recordingStrategy struct {
+	sync.Mutex
+	sample bool
+	reqs   []*sampling.Request
+}
+
+func (s *recordingStrategy) ShouldTrace(r *sampling.Request) *sampling.Decision {
+	s.Lock()
+	s.reqs = append(s.reqs, r)
+	s.Unlock()
+	return &sampling.Decision{Sample: s.sample}
+}
+
+func (s *recordingStrategy) requests() []*sampling.Request {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*sampling.Request(nil), s.reqs...)
+}
+
+// Keeps the segments it is given instead of sending them to a daemon
+type recordingEmitter struct {
+	sync.Mutex
+	segs []*xray.Segment
+}
+
+func (e *recordingEmitter) Emit(seg *xray.Segment) {
+	e.Lock()
+	e.segs = append(e.segs, seg)
+	e.Unlock()
+}
+
+func (e *recordingEmitter) RefreshEmitterWithAddress(*net.UDPAddr) {}
+
+func (e *recordingEmitter) emitted() []*xray.Segment {
+	e.Lock()
+	defer e.Unlock()
+	return append([]*xray.Segment(nil), e.segs...)
+}
+
+// Emitter of segments created from contexts without a configuration of their own
+var testEmitter = &recordingEmitter{}
+
+// Returns a copy of ctx whose segments are emitted to the returned emitter, keeping them apart from other tests
+func withRecordingEmitter(ctx context.Context) (context.Context, *recordingEmitter) {
+	e := &recordingEmitter{}
+	return contextWithConfig(ctx, func(cfg *xray.Config) { cfg.Emitter = e }), e
+}
+
+func TestMain(m *testing.M) {
+	if err := xray.Configure(xray.Config{SamplingStrategy: sampleAll{}, Emitter: testEmitter}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	xray.SetLogger(xraylog.NullLogger)
+	os.Exit(m.Run())
+}
+
+// Listens for segments on UDP like the X-Ray daemon, to inspect them as they are sent
+type fakeDaemon struct {
+	conn *net.UDPConn
+}
+
+// Starts listening on a local port until the test ends
+func startFakeDaemon(t *testing.T) *fakeDaemon {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &fakeDaemon{conn: conn}
+}
+
+func (d *fakeDaemon) addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Returns the next segment document received, failing t when none arrives within a second
+func (d *fakeDaemon) receive(t *testing.T) map[string]interface{} {
+	t.Helper()
+	buf := make([]byte, 64<<10)
+	d.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := d.conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no segment received: %v", err)
+	}
+	// Every document is preceded by a header line
+	doc := buf[:n]
+	if i := bytes.IndexByte(doc, '\n'); i >= 0 {
+		doc = doc[i+1:]
+	}
+	var seg map[string]interface{}
+	if err := json.Unmarshal(doc, &seg); err != nil {
+		t.Fatalf("malformed segment %q: %v", doc, err)
+	}
+	return seg
+}
+
+// Returns a copy of ctx whose segments are sent to d with the SDK's emitter
+func (d *fakeDaemon) context(t *testing.T, ctx context.Context) context.Context {
+	t.Helper()
+	emitter, err := xray.NewDefaultEmitter(d.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contextWithConfig(ctx, func(cfg *xray.Config) { cfg.Emitter = emitter })
+}
+
+// Returns the subsegments of the segment document doc named name
+func subsegmentsNamed(doc map[string]interface{}, name string) []map[string]interface{} {
+	var subs []map[string]interface{}
+	raw, _ := doc["subsegments"].([]interface{})
+	for _, r := range raw {
+		if sub, ok := r.(map[string]interface{}); ok && sub["name"] == name {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// Collects the messages logged by the interceptors
+type recordingLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Log(_ xraylog.LogLevel, msg fmt.Stringer) {
+	l.Lock()
+	l.messages = append(l.messages, msg.String())
+	l.Unlock()
+}
+
+func (l *recordingLogger) logged() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+// Returns a copy of the annotations of seg
+func annotations(seg *xray.Segment) map[string]interface{} {
+	seg.RLock()
+	defer seg.RUnlock()
+	a := map[string]interface{}{}
+	for k, v := range seg.Annotations {
+		a[k] = v
+	}
+	return a
+}
+
+// Returns a copy of the metadata of seg in namespace ns
+func metadataIn(seg *xray.Segment, ns string) map[string]interface{} {
+	seg.RLock()
+	defer seg.RUnlock()
+	m := map[string]interface{}{}
+	for k, v := range seg.Metadata[ns] {
+		m[k] = v
+	}
+	return m
+}
+
+// Returns a copy of the metadata of seg in the SDK's default namespace
+func metadataOf(seg *xray.Segment) map[string]interface{} {
+	return metadataIn(seg, "default")
+}
+
+// Fails t unless the annotation key of seg equals want
+func assertAnnotation(t *testing.T, seg *xray.Segment, key string, want interface{}) {
+	t.Helper()
+	if got, ok := annotations(seg)[key]; !ok || got != want {
+		t.Errorf("annotation %s = %v (set: %t), want %v", key, got, ok, want)
+	}
+}
+
+// Fails t if seg has the annotation key
+func assertNoAnnotation(t *testing.T, seg *xray.Segment, key string) {
+	t.Helper()
+	if got, ok := annotations(seg)[key]; ok {
+		t.Errorf("annotation %s = %v, want none", key, got)
+	}
+}
+
+// Returns the HTTP response status and the fault, error and throttle flags of seg
+func segmentStatus(seg *xray.Segment) (code int, fault, err, throttle bool) {
+	seg.RLock()
+	defer seg.RUnlock()
+	return seg.GetHTTP().GetResponse().Status, seg.Fault, seg.Error, seg.Throttle
+}
+
+// Waits for seg to be closed, e.g. by the stats handler once the response was sent
+func waitClosed(t *testing.T, seg *xray.Segment) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !segmentClosed(seg); {
+		if time.Now().After(deadline) {
+			t.Fatalf("segment %q was not closed", seg.Name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Runs the unary server interceptor built with opts for a call to testMethod with incoming metadata md. Returns the
+// segment handler ran with, nil when it ran untraced or was not called.
+func serveUnary(ctx context.Context, md metadata.MD, handler grpc.UnaryHandler, opts ...Option) (*xray.Segment, interface{}, error) {
+	return serveWith(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), opts...), ctx, md, handler)
+}
+
+// Like serveUnary, with the interceptor already built
+func serveWith(interceptor grpc.UnaryServerInterceptor, ctx context.Context, md metadata.MD, handler grpc.UnaryHandler) (*xray.Segment, interface{}, error) {
+	if md == nil {
+		md = metadata.MD{}
+	}
+	if handler == nil {
+		handler = func(context.Context, interface{}) (interface{}, error) { return "response", nil }
+	}
+	var seg *xray.Segment
+	resp, err := interceptor(metadata.NewIncomingContext(ctx, md), "request", &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			seg = xray.GetSegment(ctx)
+			return handler(ctx, req)
+		})
+	return seg, resp, err
+}
+
+// Returns a connection to testTarget that is never used to send anything
+func newTestConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	return newTestConnTo(t, testTarget)
+}
+
+// Like newTestConn, to target
+func newTestConnTo(t *testing.T, target string) *grpc.ClientConn {
+	t.Helper()
+	cc, err := grpc.Dial(target, grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return nil, errors.New("not dialed in tests")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// Runs the unary client interceptor built with opts for a call to testMethod on cc, under the segment of ctx or a
+// new one. Returns the subsegment invoker ran in, nil when it ran untraced. A nil invoker succeeds.
+func invokeUnary(ctx context.Context, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...Option) (*xray.Segment, error) {
+	return invokeWith(NewGrpcXrayUnaryClientInterceptor(nil, opts...), ctx, cc, invoker)
+}
+
+// Like invokeUnary, with the interceptor already built
+func invokeWith(interceptor grpc.UnaryClientInterceptor, ctx context.Context, cc *grpc.ClientConn, invoker grpc.UnaryInvoker) (*xray.Segment, error) {
+	if xray.GetSegment(ctx) == nil {
+		var root *xray.Segment
+		ctx, root = xray.BeginSegment(ctx, "test")
+		defer root.Close(nil)
+	}
+	if invoker == nil {
+		invoker = func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return nil
+		}
+	}
+	var seg *xray.Segment
+	err := interceptor(ctx, testMethod, "request", "response", cc,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			if s := xray.GetSegment(ctx); s != nil && s.ParentSegment != s {
+				seg = s
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	return seg, err
+}
+
+// Serves grpc_testing.TestService, keeping the segment of the last call
+type testServer struct {
+	testpb.UnimplementedTestServiceServer
+
+	mu  sync.Mutex
+	seg *xray.Segment
+
+	// Called by UnaryCall when set, which otherwise echoes the payload
+	unary func(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error)
+}
+
+func (s *testServer) record(ctx context.Context) {
+	s.mu.Lock()
+	s.seg = xray.GetSegment(ctx)
+	s.mu.Unlock()
+}
+
+// Returns the segment of the last call, nil when it was not traced
+func (s *testServer) segment() *xray.Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seg
+}
+
+func (s *testServer) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	s.record(ctx)
+	if s.unary != nil {
+		return s.unary(ctx, req)
+	}
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+// Echoes every request until the client closes its side
+func (s *testServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
+	s.record(stream.Context())
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{Payload: req.Payload}); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends one response per response parameter of the request
+func (s *testServer) StreamingOutputCall(req *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	s.record(stream.Context())
+	for range req.ResponseParameters {
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serves srv in memory with opts until the test ends, returning a client connected to it with dialOpts
+func startTestServer(t *testing.T, srv *testServer, opts []grpc.ServerOption, dialOpts ...grpc.DialOption) testpb.TestServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(opts...)
+	testpb.RegisterTestServiceServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	dialOpts = append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	})}, dialOpts...)
+	cc, err := grpc.Dial(testTarget, dialOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return testpb.NewTestServiceClient(cc)
+}
+
+func TestEdgeServerInterceptorConsultsSamplingRules(t *testing.T) {
+	strategy := &recordingStrategy{sample: false}
+	interceptor := NewGrpcXrayEdgeServerInterceptor(xray.NewFixedSegmentNamer("gateway"), WithSamplingStrategy(strategy))
+	seg, _, err := serveWith(interceptor, context.Background(), metadata.Pairs(":authority", "api.example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := strategy.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("strategy consulted %d times, want once", len(reqs))
+	}
+	if r := reqs[0]; r.Host != "api.example.com" || r.URL != testMethod || r.Method != GrpcMethod {
+		t.Errorf("sampling request = %+v, want host, method and URL of the call", r)
+	}
+	if seg.Sampled {
+		t.Error("segment sampled, want the strategy's decision")
+	}
+	if seg.TraceID == "" {
+		t.Error("no trace id generated")
+	}
+}
+
+func TestEdgeServerInterceptorKeepsCallerDecision(t *testing.T) {
+	strategy := &recordingStrategy{sample: false}
+	interceptor := NewGrpcXrayEdgeServerInterceptor(xray.NewFixedSegmentNamer("gateway"), WithSamplingStrategy(strategy))
+	md := metadata.Pairs(xray.TraceIDHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	seg, _, err := serveWith(interceptor, context.Background(), md, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strategy.requests()); n != 0 {
+		t.Errorf("strategy consulted %d times, want the caller's decision to be kept", n)
+	}
+	if !seg.Sampled || seg.TraceID != "1-5759e988-bd862e3fe1be46a994272793" {
+		t.Errorf("segment sampled: %t, trace id %q, want the caller's", seg.Sampled, seg.TraceID)
+	}
+}
+
+func TestUnaryMessageCounts(t *testing.T) {
+	failing := func(context.Context, interface{}) (interface{}, error) { return nil, errors.New("boom") }
+	tests := []struct {
+		name     string
+		handler  grpc.UnaryHandler
+		wantSent int
+	}{
+		{"success", nil, 1},
+		{"error", failing, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, tt.handler, WithMessageCounts(true))
+			assertAnnotation(t, seg, "grpc.recv_count", 1)
+			assertAnnotation(t, seg, "grpc.sent_count", tt.wantSent)
+
+			var invoker grpc.UnaryInvoker
+			if tt.handler != nil {
+				invoker = func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+					return errors.New("boom")
+				}
+			}
+			sub, _ := invokeUnary(context.Background(), newTestConn(t), invoker, WithMessageCounts(true))
+			assertAnnotation(t, sub, "grpc.sent_count", 1)
+			assertAnnotation(t, sub, "grpc.recv_count", tt.wantSent)
+		})
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.sent_count")
+}
+
+func TestComposeHostFromTarget(t *testing.T) {
+	hostFromTarget := ComposeHostFromTarget(GetDefaultHostFromTargetFunc("my-namespace.local"), func(host string) string {
+		return host + "-primary"
+	})
+	if got, want := hostFromTarget(testTarget), "my-service-primary"; got != want {
+		t.Errorf("hostFromTarget(%q) = %q, want %q", testTarget, got, want)
+	}
+	if got := ComposeHostFromTarget()(testTarget); got != testTarget {
+		t.Errorf("composing nothing returned %q, want the target", got)
+	}
+}
@@ -0,0 +1,82 @@
+package xray_grpc
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Returns the first value stored under key in md, or "" when there is none
+func firstMetadataValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Returns the sum of the lengths of the keys and values of md, ignoring HTTP/2 framing and compression
+func metadataSize(md metadata.MD) int {
+	size := 0
+	for key, values := range md {
+		for _, value := range values {
+			size += len(key) + len(value)
+		}
+	}
+	return size
+}
+
+// Metadata key of the idempotency key sent by clients, see WithIdempotencyAnnotation
+const idempotencyKeyMetadataKey = "x-idempotency-key"
+
+// Metadata key go-grpc-middleware's retry interceptor numbers retries with, absent from the first attempt
+const retryAttemptMetadataKey = "x-retry-attempt"
+
+// Returns the grpc-encoding the client compressed the request with, "" for uncompressed requests. grpc-go rejects
+// encodings it has no decompressor for before calling the interceptors, those requests are traced by the stats
+// handler with WithRejectedCalls instead.
+func requestEncoding(ctx context.Context, md metadata.MD) string {
+	if encoding := firstMetadataValue(md, "grpc-encoding"); encoding != "" {
+		return encoding
+	}
+	// grpc-go consumes grpc-encoding before it reaches the metadata, the transport stream keeps it
+	if s, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+		return s.RecvCompress()
+	}
+	return ""
+}
+
+// Returns the values of keys present in md, keyed by their lowercase metadata key
+func metadataSubset(md metadata.MD, keys []string) map[string][]string {
+	subset := map[string][]string{}
+	for _, key := range keys {
+		if values := md.Get(key); len(values) > 0 {
+			subset[strings.ToLower(key)] = values
+		}
+	}
+	return subset
+}
+
+// Copies the values of keys from the incoming metadata of ctx to its outgoing metadata. Keys already present in
+// the outgoing metadata are left untouched.
+func propagateMetadata(ctx context.Context, keys []string) context.Context {
+	in, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	out, _ := metadata.FromOutgoingContext(ctx)
+	var kv []string
+	for _, key := range keys {
+		if len(out.Get(key)) > 0 {
+			continue
+		}
+		for _, value := range in.Get(key) {
+			kv = append(kv, key, value)
+		}
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
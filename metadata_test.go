@@ -0,0 +1,159 @@
+package xray_grpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestPropagatedMetadata(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-tenant-id", "acme",
+		"x-request-id", "incoming",
+		"authorization", "secret"))
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "outgoing")
+
+	var out metadata.MD
+	_, err := invokeUnary(ctx, newTestConn(t), func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		out, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}, WithPropagatedMetadata([]string{"x-tenant-id", "x-request-id"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Get("x-tenant-id"); len(got) != 1 || got[0] != "acme" {
+		t.Errorf("x-tenant-id = %q, want it copied from the incoming metadata", got)
+	}
+	if got := out.Get("x-request-id"); len(got) != 1 || got[0] != "outgoing" {
+		t.Errorf("x-request-id = %q, want the outgoing value kept", got)
+	}
+	if got := out.Get("authorization"); len(got) != 0 {
+		t.Errorf("authorization = %q, want unlisted keys left out", got)
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	md := metadata.Pairs("x-tenant-id", "acme", "accept-language", "fr", "accept-language", "en", "authorization", "secret")
+	seg, _, _ := serveUnary(context.Background(), md, nil, WithRequestHeaders([]string{"X-Tenant-Id", "accept-language", "x-missing"}))
+
+	want := map[string][]string{"x-tenant-id": {"acme"}, "accept-language": {"fr", "en"}}
+	if got := metadataIn(seg, "http")["request_headers"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("request headers = %v, want %v", got, want)
+	}
+
+	seg, _, _ = serveUnary(context.Background(), md, nil)
+	if got, ok := metadataIn(seg, "http")["request_headers"]; ok {
+		t.Errorf("request headers = %v, want none by default", got)
+	}
+}
+
+func TestIdempotencyAnnotation(t *testing.T) {
+	for _, keyed := range []bool{true, false} {
+		md := metadata.MD{}
+		ctx := context.Background()
+		if keyed {
+			md = metadata.Pairs(idempotencyKeyMetadataKey, "order-42")
+			ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyMetadataKey, "order-42")
+		}
+		seg, _, _ := serveUnary(context.Background(), md, nil, WithIdempotencyAnnotation(true))
+		assertAnnotation(t, seg, "grpc.idempotent", keyed)
+		sub, _ := invokeUnary(ctx, newTestConn(t), nil, WithIdempotencyAnnotation(true))
+		assertAnnotation(t, sub, "grpc.idempotent", keyed)
+	}
+}
+
+func TestMetadataBytesAnnotation(t *testing.T) {
+	md := metadata.Pairs("x-tenant-id", "acme", "x-request-id", "1", "x-request-id", "22")
+	seg, _, _ := serveUnary(context.Background(), md, nil, WithMetadataBytes(true))
+	// x-tenant-id + acme, and x-request-id twice with its values
+	assertAnnotation(t, seg, "grpc.metadata_bytes", 11+4+12+1+12+2)
+
+	seg, _, _ = serveUnary(context.Background(), md, nil)
+	assertNoAnnotation(t, seg, "grpc.metadata_bytes")
+}
+
+func TestMetadataNamespaces(t *testing.T) {
+	md := metadata.Pairs("x-query-id", "q-42", "x-tenant-id", "acme")
+	namespaces := WithMetadataNamespaces(map[string]string{"X-Query-ID": "sql", "x-tenant-id": "tenant", "x-absent": "sql"})
+	seg, _, _ := serveUnary(context.Background(), md, nil, namespaces)
+
+	if got, want := metadataIn(seg, "sql"), map[string]interface{}{"x-query-id": "q-42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sql metadata = %v, want %v", got, want)
+	}
+	if got := metadataIn(seg, "tenant")["x-tenant-id"]; got != "acme" {
+		t.Errorf("tenant.x-tenant-id = %v, want acme", got)
+	}
+	if got := metadataOf(seg)["x-query-id"]; got != nil {
+		t.Errorf("default.x-query-id = %v, want the value only in its namespace", got)
+	}
+}
+
+// A legacy compressor the server has no decompressor for, leaving data uncompressed
+type unknownCompressor struct{}
+
+func (unknownCompressor) Do(w io.Writer, p []byte) error { _, err := w.Write(p); return err }
+func (unknownCompressor) Type() string                   { return "x-unknown" }
+
+func TestRequestEncoding(t *testing.T) {
+	srv := &testServer{}
+	client := startTestServer(t, srv, []grpc.ServerOption{
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"))),
+	})
+	if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}, grpc.UseCompressor("gzip")); err != nil {
+		t.Fatal(err)
+	}
+	seg := srv.segment()
+	waitClosed(t, seg)
+	if got := metadataOf(seg)["grpc.encoding"]; got != "gzip" {
+		t.Errorf("grpc.encoding = %v, want gzip", got)
+	}
+
+	// Rejected by grpc-go before the interceptor runs, traced by the stats handler
+	daemon := startFakeDaemon(t)
+	srv = &testServer{}
+	namer := xray.NewFixedSegmentNamer("test")
+	handler := NewStatsHandler(WithRejectedCalls(namer), WithDaemonAddress(daemon.addr().String()))
+	client = startTestServer(t, srv, []grpc.ServerOption{
+		grpc.StatsHandler(handler),
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(namer)),
+	}, grpc.WithCompressor(unknownCompressor{}))
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("err = %v, want Unimplemented", err)
+	}
+	if seg := srv.segment(); seg != nil {
+		t.Errorf("handler reached with segment %q", seg.Name)
+	}
+	doc := daemon.receive(t)
+	metadata, _ := doc["metadata"].(map[string]interface{})["default"].(map[string]interface{})
+	response, _ := doc["http"].(map[string]interface{})["response"].(map[string]interface{})
+	if doc["name"] != "test" || metadata["grpc.encoding"] != "x-unknown" || response["status"] != float64(501) || doc["fault"] != true {
+		t.Errorf("rejected call traced as %v, want its encoding and status", doc)
+	}
+
+	// Failed calls that reached the interceptor are not traced again
+	srv = &testServer{unary: func(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		return nil, status.Error(codes.NotFound, "no such order")
+	}}
+	client = startTestServer(t, srv, []grpc.ServerOption{
+		grpc.StatsHandler(handler),
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(namer)),
+	})
+	if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}); status.Code(err) != codes.NotFound {
+		t.Fatalf("err = %v, want NotFound", err)
+	}
+	daemon.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := daemon.conn.Read(make([]byte, 64<<10)); err == nil {
+		t.Errorf("traced by the stats handler too, received %d bytes", n)
+	}
+}
@@ -0,0 +1,44 @@
+package xray_grpc
+
+import (
+	"strings"
+)
+
+// Splits a full gRPC method such as /my.pkg.Service/Get into its service (my.pkg.Service) and method (Get)
+func parseFullMethod(fullMethod string) (service, method string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndexByte(fullMethod, '/'); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return fullMethod, ""
+}
+
+// Returns the protobuf package of the service of fullMethod, e.g. orders for /orders.OrderService/Get, or "" for
+// services declared without a package
+func methodPackage(fullMethod string) string {
+	service, _ := parseFullMethod(fullMethod)
+	if i := strings.LastIndexByte(service, '.'); i >= 0 {
+		return service[:i]
+	}
+	return ""
+}
+
+// Expands the {service} and {method} placeholders of template from fullMethod. Other placeholders are left as is.
+func expandSegmentNameTemplate(template, fullMethod string) string {
+	service, method := parseFullMethod(fullMethod)
+	return strings.NewReplacer("{service}", service, "{method}", method).Replace(template)
+}
+
+// Returns the grpc.method_type annotation value for a method streaming in the given directions
+func methodType(clientStream, serverStream bool) string {
+	switch {
+	case clientStream && serverStream:
+		return "bidi"
+	case clientStream:
+		return "client_stream"
+	case serverStream:
+		return "server_stream"
+	default:
+		return "unary"
+	}
+}
@@ -0,0 +1,70 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSegmentNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{service}", "test.Service"},
+		{"{service}/{method}", "test.Service/Method"},
+		{"api-{method}", "api-Method"},
+	}
+	for _, tt := range tests {
+		seg, _, err := serveUnary(context.Background(), nil, nil, WithSegmentNameTemplate(tt.template))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seg.Name != tt.want {
+			t.Errorf("template %q named the segment %q, want %q", tt.template, seg.Name, tt.want)
+		}
+	}
+}
+
+func TestExpandSegmentNameTemplateKeepsUnknownPlaceholders(t *testing.T) {
+	if got, want := expandSegmentNameTemplate("{service}.{unknown}", testMethod), "test.Service.{unknown}"; got != want {
+		t.Errorf("expandSegmentNameTemplate() = %q, want %q", got, want)
+	}
+}
+
+func TestMethodPackage(t *testing.T) {
+	tests := []struct {
+		fullMethod string
+		want       string
+	}{
+		{"/orders.OrderService/Get", "orders"},
+		{"/acme.orders.v1.OrderService/Get", "acme.orders.v1"},
+		{"/OrderService/Get", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := methodPackage(tt.fullMethod); got != tt.want {
+			t.Errorf("methodPackage(%q) = %q, want %q", tt.fullMethod, got, tt.want)
+		}
+	}
+}
+
+func TestPackageAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), nil, nil, WithPackageAnnotation(true))
+	assertAnnotation(t, seg, "grpc.package", "test")
+	sub, _ := invokeUnary(context.Background(), newTestConn(t), nil, WithPackageAnnotation(true))
+	assertAnnotation(t, sub, "grpc.package", "test")
+
+	interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithPackageAnnotation(true))
+	_, err := interceptor(metadata.NewIncomingContext(context.Background(), metadata.MD{}), nil, &grpc.UnaryServerInfo{FullMethod: "/Health/Check"},
+		func(ctx context.Context, _ interface{}) (interface{}, error) {
+			assertNoAnnotation(t, xray.GetSegment(ctx), "grpc.package")
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+package xray_grpc
+
+import (
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+)
+
+// Bundles the client and server interceptors of this package, built from one shared configuration, for frameworks
+// that expect a single middleware object.
+type Middleware struct {
+	hostFromTarget func(string) string
+	sn             xray.SegmentNamer
+	// Resolved once, so plugins and emitters are not set up again for every interceptor
+	o *options
+}
+
+// Returns a Middleware whose client interceptors name subsegments with hostFromTarget and whose server interceptors
+// name segments with sn, all configured with opts. Either may be nil when only the other side is used.
+// Usage:
+//
+// m := xray_grpc.NewMiddleware(customHostFromTarget, xray.NewFixedSegmentNamer("my-service"))
+// s := grpc.NewServer(grpc.UnaryInterceptor(m.UnaryServer()), grpc.StreamInterceptor(m.StreamServer()))
+//
+func NewMiddleware(hostFromTarget func(string) string, sn xray.SegmentNamer, opts ...Option) *Middleware {
+	return &Middleware{
+		hostFromTarget: hostFromTarget,
+		sn:             sn,
+		o:              newServerOptions(opts),
+	}
+}
+
+// Returns the interceptor built by NewGrpcXrayUnaryClientInterceptor
+func (m *Middleware) UnaryClient() grpc.UnaryClientInterceptor {
+	return m.o.unaryClientInterceptor(m.hostFromTarget)
+}
+
+// Returns the interceptor built by NewGrpcXrayUnaryServerInterceptor
+func (m *Middleware) UnaryServer() grpc.UnaryServerInterceptor {
+	return m.o.unaryServerInterceptor(m.sn)
+}
+
+// Returns the interceptor built by NewGrpcXrayStreamClientInterceptor
+func (m *Middleware) StreamClient() grpc.StreamClientInterceptor {
+	return m.o.streamClientInterceptor(m.hostFromTarget)
+}
+
+// Returns the interceptor built by NewGrpcXrayStreamServerInterceptor
+func (m *Middleware) StreamServer() grpc.StreamServerInterceptor {
+	return m.o.streamServerInterceptor(m.sn)
+}
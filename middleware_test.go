@@ -0,0 +1,43 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+func TestMiddlewareSharesConfiguration(t *testing.T) {
+	inits := 0
+	m := NewMiddleware(GetDefaultHostFromTargetFunc("my-namespace.local"), xray.NewFixedSegmentNamer("my-service"),
+		WithPlugins(func() { inits++ }), WithHTTPMethod("GET"))
+	for i := 0; i < 2; i++ {
+		m.UnaryClient()
+		m.UnaryServer()
+		m.StreamClient()
+		m.StreamServer()
+	}
+	if inits != 1 {
+		t.Errorf("plugins initialised %d times, want once", inits)
+	}
+
+	seg, _, err := serveWith(m.UnaryServer(), context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := invokeWith(m.UnaryClient(), context.Background(), newTestConn(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.Name != "my-service" || sub.Name != "my-service" {
+		t.Errorf("named %q and %q, want the namer and hostFromTarget to be used", seg.Name, sub.Name)
+	}
+	for _, s := range []*xray.Segment{seg, sub} {
+		s.RLock()
+		method := s.GetHTTP().GetRequest().Method
+		s.RUnlock()
+		if method != "GET" {
+			t.Errorf("%s: request method = %q, want the shared option to apply", s.Name, method)
+		}
+	}
+}
@@ -0,0 +1,776 @@
+package xray_grpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/aws/aws-xray-sdk-go/xraylog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Configures the interceptors returned by NewGrpcXrayUnaryClientInterceptor and NewGrpcXrayUnaryServerInterceptor.
+// Options that only make sense on one side are ignored by the other.
+type Option func(*options)
+
+// Called with the (sub)segment and the request message before the request is sent (client) or handled (server).
+type RequestAnnotator func(ctx context.Context, seg *xray.Segment, req interface{})
+
+// Called with the (sub)segment, the response message and the returned error once the call has completed.
+type ResponseAnnotator func(ctx context.Context, seg *xray.Segment, resp interface{}, err error)
+
+// Called by the unary server interceptor with the new segment before the handler. A non-nil error rejects the call:
+// the handler is skipped and the error is recorded and returned like one from the handler.
+type PreHandler func(ctx context.Context, seg *xray.Segment, info *grpc.UnaryServerInfo) error
+
+type options struct {
+	requestAnnotator         RequestAnnotator
+	responseAnnotator        ResponseAnnotator
+	annotationSampleRate     float64
+	randFloat64              func() float64
+	logger                   xraylog.Logger
+	edge                     bool
+	samplingStrategy         sampling.Strategy
+	messageCounts            bool
+	fullMethodSubsegmentName bool
+	streamContentLength      bool
+	propagatedMetadata       []string
+	instanceID               string
+	httpMethod               string
+	segmentNameTemplate      string
+	metadataCount            bool
+	alwaysPropagateContext   bool
+	urlSanitizer             func(string) string
+	captureValidation        bool
+	spiffePeerIdentity       bool
+	retryCoalescer           *retryCoalescer
+	traceIDInError           bool
+	requestHeaders           []string
+	shadowMode               bool
+	daemonAddress            string
+	emitter                  xray.Emitter
+	packageAnnotation        bool
+	businessCode             bool
+	closeStreamOnError       bool
+	preHandler               PreHandler
+	idempotencyAnnotation    bool
+	traceTrailers            bool
+	emptyResponseAnnotation  bool
+	now                      func() time.Time
+	metadataBytes            bool
+	nameSanitizer            func(string) string
+	plugins                  []func()
+	localeAnnotation         bool
+	disableHTTPStatus        bool
+	recvSubsegments          bool
+	capturePeer              bool
+	appStatusHeader          string
+	maxAnnotations           int
+	clientErrorFilter        func(error) bool
+	clientIPMetadataKey      string
+	samplingRuleAnnotation   bool
+	userAgentMetadata        bool
+	subsegmentCount          bool
+	attemptNaming            bool
+	backendCount             func(*grpc.ClientConn) int
+	synchronousEmit          bool
+	peerOrganization         bool
+	headerParser             func(metadata.MD) (header.Header, bool)
+	headerInjector           func(context.Context, header.Header) context.Context
+	metadataNamespaces       map[string]string
+	regionTagger             func(string) (string, string, bool)
+	methodSLO                map[string]time.Duration
+	onSegmentStart           func(context.Context, *xray.Segment)
+	onSegmentEnd             func(context.Context, *xray.Segment, error)
+	rejectedCallNamer        xray.SegmentNamer
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		annotationSampleRate: 1,
+		httpMethod:           GrpcMethod,
+		urlSanitizer:         func(url string) string { return url },
+		randFloat64:          rand.Float64,
+		now:                  time.Now,
+		nameSanitizer:        sanitizeSegmentName,
+		capturePeer:          true,
+		maxAnnotations:       defaultMaxAnnotations,
+		logger:               xraylog.NewDefaultLogger(os.Stderr, xraylog.LogLevelInfo),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Like newOptions, resolving defaults that only matter to server interceptors
+func newServerOptions(opts []Option) *options {
+	o := newOptions(opts)
+	if o.instanceID == "" {
+		o.instanceID = defaultInstanceID()
+	}
+	// The SDK adds the metadata of active plugins to every segment it creates
+	for _, init := range o.plugins {
+		init()
+	}
+	if o.daemonAddress != "" {
+		emitter, err := newDaemonEmitter(o.daemonAddress)
+		if err != nil {
+			o.warnf("xray_grpc: %v, using the configured emitter", err)
+		} else {
+			o.emitter = emitter
+			registerEmitter(emitter)
+		}
+	}
+	return o
+}
+
+// Returns an Option that calls fn for every traced call before the request is sent (client) or handled (server).
+// fn must not hold the segment lock while calling segment methods such as AddAnnotation.
+func WithRequestAnnotator(fn RequestAnnotator) Option {
+	return func(o *options) {
+		o.requestAnnotator = fn
+	}
+}
+
+// Returns an Option that calls fn for every traced call once the response (or error) is known.
+// fn must not hold the segment lock while calling segment methods such as AddAnnotation.
+func WithResponseAnnotator(fn ResponseAnnotator) Option {
+	return func(o *options) {
+		o.responseAnnotator = fn
+	}
+}
+
+// Returns an Option that only runs the request/response annotators for a fraction of calls. rate is between
+// 0 (never) and 1 (always, the default). Basic segment data such as the status is recorded for every call.
+func WithAnnotationSampleRate(rate float64) Option {
+	return func(o *options) {
+		o.annotationSampleRate = rate
+	}
+}
+
+// Returns an Option that replaces the random number source used for sampling decisions made by this package.
+// fn must return a value in [0, 1) and be safe for concurrent use. Mostly useful for tests.
+func WithRand(fn func() float64) Option {
+	return func(o *options) {
+		o.randFloat64 = fn
+	}
+}
+
+// Returns an Option that sets the logger used to report problems such as misordered interceptor chains.
+// Defaults to logging warnings and errors to stderr, use xraylog.NullLogger to silence it.
+func WithLogger(l xraylog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// Returns an Option that makes the server interceptor use s, instead of the globally configured strategy, to decide
+// whether new segments are sampled. Combined with NewGrpcXrayEdgeServerInterceptor this allows e.g. sampling 5%
+// of a high-volume method. Client subsegments always follow the sampling decision of their parent.
+func WithSamplingStrategy(s sampling.Strategy) Option {
+	return func(o *options) {
+		o.samplingStrategy = s
+	}
+}
+
+// Returns an Option that records grpc.sent_count and grpc.recv_count annotations, the number of messages sent and
+// received by the call. For unary calls these are always 1, except that no response is counted when the call
+// failed. Keeps dashboards consistent with streaming calls. Disabled by default.
+func WithMessageCounts(enabled bool) Option {
+	return func(o *options) {
+		o.messageCounts = enabled
+	}
+}
+
+// Returns an Option that names client subsegments after the full gRPC method (e.g. /my.Service/Get) instead of
+// the host returned by hostFromTarget.
+func WithFullMethodSubsegmentName(enabled bool) Option {
+	return func(o *options) {
+		o.fullMethodSubsegmentName = enabled
+	}
+}
+
+// Returns an Option that controls whether stream interceptors compute the size of every message to populate the
+// content length. Sizing each message of a high-throughput stream is costly, so this is disabled by default.
+// Unary interceptors are not affected.
+func WithStreamContentLength(enabled bool) Option {
+	return func(o *options) {
+		o.streamContentLength = enabled
+	}
+}
+
+// Returns an Option that makes the client interceptor forward the listed metadata keys (e.g. tenant or request
+// ids) from the incoming context to the outgoing call, keeping correlation flowing through fan-outs. Keys already
+// set on the outgoing context are not overwritten.
+func WithPropagatedMetadata(keys []string) Option {
+	return func(o *options) {
+		o.propagatedMetadata = keys
+	}
+}
+
+// Returns an Option that sets the instance.id annotation recorded on server segments, useful to pinpoint the
+// replica that handled a request. Defaults to the HOSTNAME environment variable, or the host name reported by the
+// kernel when it is unset.
+func WithInstanceID(id string) Option {
+	return func(o *options) {
+		o.instanceID = id
+	}
+}
+
+// Resolves the instance id used when WithInstanceID is not given
+func defaultInstanceID() string {
+	if h := os.Getenv("HOSTNAME"); h != "" {
+		return h
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
+// Returns an Option that overrides the HTTP method recorded on (sub)segments, GrpcMethod by default. Useful for
+// gRPC-Web or custom transports.
+func WithHTTPMethod(method string) Option {
+	return func(o *options) {
+		o.httpMethod = method
+	}
+}
+
+// Returns an Option that names server segments from template instead of the SegmentNamer. The placeholders
+// {service} and {method} are replaced with the parts of the full method, e.g. "{service}/{method}" names calls to
+// /my.pkg.Service/Get "my.pkg.Service/Get". Unknown placeholders are kept literally.
+func WithSegmentNameTemplate(template string) Option {
+	return func(o *options) {
+		o.segmentNameTemplate = template
+	}
+}
+
+// Returns an Option that records the number of incoming metadata keys as the grpc.metadata_count annotation on
+// server segments, to help spot callers sending oversized headers.
+func WithMetadataCount(enabled bool) Option {
+	return func(o *options) {
+		o.metadataCount = enabled
+	}
+}
+
+// Returns an Option that makes the trace id of unsampled server requests available via TraceIDFromContext, so logs
+// can be correlated even when no segment is emitted. Unsampled segments are still never sent to the daemon.
+func WithAlwaysPropagateContext(enabled bool) Option {
+	return func(o *options) {
+		o.alwaysPropagateContext = enabled
+	}
+}
+
+// Returns an Option that rewrites the full method before it is recorded as the (sub)segment URL, e.g. to redact
+// ids from dynamically named methods. The default records the full method unchanged.
+func WithURLSanitizer(fn func(string) string) Option {
+	return func(o *options) {
+		o.urlSanitizer = fn
+	}
+}
+
+// Returns an Option that makes the server interceptor time the Validate() method of requests generated with
+// protoc-gen-validate in a "validate" subsegment, recording validation errors as exceptions. Requests without a
+// Validate() error method are not affected.
+func WithValidationSubsegment(enabled bool) Option {
+	return func(o *options) {
+		o.captureValidation = enabled
+	}
+}
+
+// Returns an Option that records the SPIFFE ID found in the client certificate's URI SANs as the
+// grpc.peer_identity annotation on server segments. In a service mesh with mTLS this identifies the calling
+// workload, where the client IP usually belongs to a proxy.
+func WithSPIFFEPeerIdentity(enabled bool) Option {
+	return func(o *options) {
+		o.spiffePeerIdentity = enabled
+	}
+}
+
+// Returns an Option that makes the unary client interceptor record retries of a failed call on the subsegment of the
+// first attempt, with the number of retries as the grpc.retry_count annotation. A retry is a call to the same method
+// from the same parent segment starting within window of the previous attempt failing. The subsegment of a failed
+// call is therefore closed up to window later than the call returned. Its status and flags are those of the latest
+// attempt, the exceptions of failed attempts are kept. Disabled by default.
+func WithRetryCoalescing(window time.Duration) Option {
+	return func(o *options) {
+		if window <= 0 {
+			o.retryCoalescer = nil
+			return
+		}
+		o.retryCoalescer = &retryCoalescer{window: window, pending: map[retryKey]*pendingRetry{}}
+	}
+}
+
+// Returns an Option that makes the server interceptors append the trace id to the message of errors returned by
+// handlers, e.g. "not found [trace: 1-5f84c7a4-...]", so clients can quote it in bug reports. The gRPC code and
+// details of the error are preserved.
+func WithTraceIDInError(enabled bool) Option {
+	return func(o *options) {
+		o.traceIDInError = enabled
+	}
+}
+
+// Returns an Option that records the incoming metadata values of keys on server segments as request headers, to
+// make gRPC traces read like HTTP ones. X-Ray segment documents have no field for HTTP headers, so they are stored
+// as metadata under request_headers in the "http" namespace. Keys that are absent from a request are skipped.
+func WithRequestHeaders(keys []string) Option {
+	return func(o *options) {
+		o.requestHeaders = keys
+	}
+}
+
+// Returns an Option that makes the server interceptors build and close segments as usual, but drop them instead of
+// sending them to the daemon. Subsegments of dropped segments, including those of downstream calls, are dropped as
+// well. Useful to measure the overhead of a tracing configuration in production without paying for the traces.
+// Downstream calls made with the client interceptors send a trace header marked not sampled. The X-Ray SDK's HTTP
+// handler and NewGrpcXrayEdgeServerInterceptor honour it, but downstream services traced with
+// NewGrpcXrayUnaryServerInterceptor make their own sampling decision and may still record segments, orphaned from
+// the dropped parent.
+func WithShadowMode(enabled bool) Option {
+	return func(o *options) {
+		o.shadowMode = enabled
+	}
+}
+
+// Returns an Option that makes the server interceptor send its segments, and their subsegments, to the X-Ray
+// daemon listening on the UDP address addr (e.g. "127.0.0.1:2000") instead of the globally configured one, through
+// an emitter dedicated to the interceptor. Unlike xray.Configure, AWS_XRAY_DAEMON_ADDRESS does not override addr.
+// An address that can not be resolved is logged and ignored.
+func WithDaemonAddress(addr string) Option {
+	return func(o *options) {
+		o.daemonAddress = addr
+	}
+}
+
+// Returns an Option that annotates (sub)segments with the protobuf package of the called service as grpc.package,
+// e.g. orders for /orders.OrderService/Get. Methods of services without a package are not annotated.
+func WithPackageAnnotation(enabled bool) Option {
+	return func(o *options) {
+		o.packageAnnotation = enabled
+	}
+}
+
+// Annotates seg with the package of fullMethod when enabled with WithPackageAnnotation
+func (o *options) annotatePackage(seg *xray.Segment, fullMethod string) {
+	if !o.packageAnnotation {
+		return
+	}
+	if pkg := methodPackage(fullMethod); pkg != "" {
+		o.addAnnotation(xraySegment{seg}, "grpc.package", pkg)
+	}
+}
+
+// Returns an Option that makes the server interceptors annotate segments with business.code when the handler
+// returns an error implementing interface{ BusinessCode() string }, directly or wrapped (see errors.As). Errors
+// without a business code, or with an empty one, are not annotated.
+func WithBusinessCode(enabled bool) Option {
+	return func(o *options) {
+		o.businessCode = enabled
+	}
+}
+
+// Returns an Option that makes the stream client interceptor close the subsegment as soon as SendMsg fails with an
+// error other than io.EOF, which ends the stream, instead of when the caller next calls RecvMsg or ctx is done. The
+// subsegment is always closed on the first RecvMsg error. Disabled by default, as the caller may still read the
+// status with RecvMsg.
+func WithCloseStreamOnError(enabled bool) Option {
+	return func(o *options) {
+		o.closeStreamOnError = enabled
+	}
+}
+
+// Returns an Option that calls fn before each traced unary handler, e.g. for admission control that takes the
+// segment into account. See PreHandler.
+func WithPreHandler(fn PreHandler) Option {
+	return func(o *options) {
+		o.preHandler = fn
+	}
+}
+
+// Returns an Option that annotates (sub)segments with grpc.idempotent, telling whether the call carries an
+// x-idempotency-key metadata header (outgoing on the client, incoming on the server). The key itself is not recorded.
+func WithIdempotencyAnnotation(enabled bool) Option {
+	return func(o *options) {
+		o.idempotencyAnnotation = enabled
+	}
+}
+
+// Returns an Option that makes the server interceptors send the trace id and segment id of each call in the
+// response trailers, as x-xray-trace-id and x-xray-segment-id, for tools that link a response to its trace.
+func WithTraceTrailers(enabled bool) Option {
+	return func(o *options) {
+		o.traceTrailers = enabled
+	}
+}
+
+// Returns an Option that annotates unary server segments with grpc.empty_response when the handler succeeded
+// without a response message, i.e. returned a nil response and a nil error, to flag potentially missing data.
+func WithEmptyResponseAnnotation(enabled bool) Option {
+	return func(o *options) {
+		o.emptyResponseAnnotation = enabled
+	}
+}
+
+// Returns an Option that replaces the clock the interceptors use to measure durations, such as grpc.ttfb_ms and
+// grpc.slo_breach, e.g. with a fake clock in tests. Segment start and end times are set by the X-Ray SDK, and the
+// remaining budget in grpc.timeout is measured on the wall clock like context deadlines, so neither is affected.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// Returns an Option that annotates server segments with grpc.metadata_bytes, the approximate size of the incoming
+// metadata as the sum of the lengths of its keys and values, to spot header bloat.
+func WithMetadataBytes(enabled bool) Option {
+	return func(o *options) {
+		o.metadataBytes = enabled
+	}
+}
+
+// Returns an Option that replaces how (sub)segment names are made acceptable to X-Ray, which drops segments with
+// invalid names. The default removes invalid characters and truncates names to 200 characters.
+func WithNameSanitizer(fn func(string) string) Option {
+	return func(o *options) {
+		o.nameSanitizer = fn
+	}
+}
+
+// Returns an Option that activates X-Ray SDK plugins, such as Init of the ec2, ecs or beanstalk packages of
+// github.com/aws/aws-xray-sdk-go/awsplugins, when the server interceptor is created. Segments then carry the
+// platform metadata and origin detected by the plugins, so the service map shows the right compute platform.
+// Activating a plugin that is already active has no effect.
+// Usage:
+//
+// xray_grpc.NewGrpcXrayUnaryServerInterceptor(sn, xray_grpc.WithPlugins(ecs.Init, ec2.Init))
+//
+func WithPlugins(inits ...func()) Option {
+	return func(o *options) {
+		o.plugins = append(o.plugins, inits...)
+	}
+}
+
+// Returns an Option that annotates server segments with the first accept-language metadata value as grpc.locale,
+// to analyze traces by language or region. Requests without the header are not annotated.
+func WithLocaleAnnotation(enabled bool) Option {
+	return func(o *options) {
+		o.localeAnnotation = enabled
+	}
+}
+
+// Returns an Option that leaves the HTTP response status of (sub)segments unset and records the gRPC code (e.g.
+// NotFound) as the grpc.status_code annotation instead, for dashboards built on gRPC codes. Segments are still
+// flagged as error, throttle or fault from the closest HTTP status.
+func WithDisableHTTPStatus(enabled bool) Option {
+	return func(o *options) {
+		o.disableHTTPStatus = enabled
+	}
+}
+
+// Returns an Option that makes the stream server interceptor time each RecvMsg call of the handler in a "recv"
+// subsegment, separating the time spent reading (waiting for the client included) and deserializing inbound
+// messages from the handler's own processing time.
+func WithRecvSubsegments(enabled bool) Option {
+	return func(o *options) {
+		o.recvSubsegments = enabled
+	}
+}
+
+// Returns an Option that, when disabled, makes the server interceptors skip looking up the peer of each call, for
+// hot paths that don't need it. Segments then have no client IP nor grpc.tls annotation, and WithSPIFFEPeerIdentity
+// has no effect. Enabled by default.
+func WithCapturePeer(enabled bool) Option {
+	return func(o *options) {
+		o.capturePeer = enabled
+	}
+}
+
+// Returns an Option that makes the server interceptors annotate segments with app.status, the value of the
+// response header key (e.g. grpc-status-detail) set by the handler with grpc.SetHeader, grpc.SendHeader or their
+// grpc.ServerStream counterparts. This records a finer grained application status than the gRPC code.
+func WithAppStatusHeader(key string) Option {
+	return func(o *options) {
+		o.appStatusHeader = key
+	}
+}
+
+// Most annotations X-Ray indexes per trace, see
+// https://docs.aws.amazon.com/xray/latest/devguide/xray-api-segmentdocuments.html#api-segmentdocuments-annotations
+const defaultMaxAnnotations = 50
+
+// Returns an Option that caps the number of annotations on a (sub)segment, 50 by default. Annotations beyond the cap,
+// whether added by the interceptors or by annotators, are dropped with a warning instead of being discarded by
+// X-Ray without notice. Annotations that were set first are kept. n <= 0 removes the cap.
+func WithMaxAnnotations(n int) Option {
+	return func(o *options) {
+		o.maxAnnotations = n
+	}
+}
+
+// Returns an Option that makes the client interceptors flag subsegments as error, throttle or fault, and record the
+// exception, only for errors fn returns true for. Other errors, e.g. an expected NotFound from a cache lookup, are
+// recorded with their status only. By default every error counts.
+func WithClientErrorFilter(fn func(err error) bool) Option {
+	return func(o *options) {
+		o.clientErrorFilter = fn
+	}
+}
+
+// Returns an Option that makes the server interceptors record the first value of the incoming metadata key as the
+// client IP, instead of the peer address, for proxies that pass the address of the original client in a header
+// (e.g. x-real-ip). Requests without the key fall back to the peer address.
+func WithClientIPFromMetadata(key string) Option {
+	return func(o *options) {
+		o.clientIPMetadataKey = key
+	}
+}
+
+// Returns an Option that annotates server segments with the name of the sampling rule that matched the request as
+// xray.sampling_rule, to audit sampling per method. Only decisions made by the sampling strategy carry a rule, e.g.
+// at the edge (see NewGrpcXrayEdgeServerInterceptor) or with WithSamplingStrategy.
+func WithSamplingRuleAnnotation(enabled bool) Option {
+	return func(o *options) {
+		o.samplingRuleAnnotation = enabled
+	}
+}
+
+// Returns an Option that records the user-agent a client call was sent with as grpc.user_agent metadata, which
+// includes the prefix set with grpc.WithUserAgent, to debug routing on the user-agent. The user-agent is read from
+// the outgoing header, which requires the stats handler returned by NewStatsHandler on the client connection.
+// Usage:
+//
+// conn, err := grpc.Dial(target, grpc.WithUserAgent("my-client/1.0"),
+//                        grpc.WithStatsHandler(xray_grpc.NewStatsHandler()),
+//                        grpc.WithUnaryInterceptor(xray_grpc.NewGrpcXrayUnaryClientInterceptor(nil, xray_grpc.WithUserAgentMetadata(true))))
+//
+func WithUserAgentMetadata(enabled bool) Option {
+	return func(o *options) {
+		o.userAgentMetadata = enabled
+	}
+}
+
+// Returns an Option that annotates server segments with the number of subsegments started while handling the
+// request as grpc.subsegment_count, to spot N+1 fan-out. The SDK does not expose the children of a segment, only the
+// subsegments of this package are counted: downstream calls made with the client interceptors and
+// CaptureGRPCSubsegment.
+func WithSubsegmentCount(enabled bool) Option {
+	return func(o *options) {
+		o.subsegmentCount = enabled
+	}
+}
+
+// Returns an Option that makes the server interceptor sample a fixed fraction of calls, rate between 0 (never) and
+// 1 (always), instead of evaluating the X-Ray sampling rules. Calls that are not sampled are not emitted. It is a
+// shorthand for WithSamplingStrategy, the last of the two wins, so at the edge calls whose trace header carries a
+// sampling decision keep it. The decision uses the source set with WithRand.
+func WithSampleRate(rate float64) Option {
+	return func(o *options) {
+		// WithRand may come later in the options
+		o.samplingStrategy = &rateSamplingStrategy{rate: rate, rand: func() float64 { return o.randFloat64() }}
+	}
+}
+
+// Returns an Option that names the subsegments of retried client calls "<host> attempt N", so retries stack up
+// visibly on the X-Ray timeline. Retries are numbered by the x-retry-attempt metadata of go-grpc-middleware's retry
+// interceptor, which must run before the interceptors of this package; grpc-go's built-in retries happen below
+// interceptors and can not be told apart. The first attempt keeps the plain name. Ignored with WithRetryCoalescing,
+// which records retries on the subsegment of the first attempt instead.
+// Usage:
+//
+// conn, err := grpc.Dial(target,
+//                        grpc.WithChainUnaryInterceptor(grpc_retry.UnaryClientInterceptor(),
+//                                                       xray_grpc.NewGrpcXrayUnaryClientInterceptor(nil, xray_grpc.WithAttemptNaming(true))))
+//
+func WithAttemptNaming(enabled bool) Option {
+	return func(o *options) {
+		o.attemptNaming = enabled
+	}
+}
+
+// Returns an Option that annotates client subsegments with the number of backends the connection can pick from as
+// grpc.backend_count, to debug load balancing. grpc-go does not expose the ready subconns of a connection, fn must
+// provide them, e.g. from a custom balancer or picker. A negative count is not recorded.
+// Usage:
+//
+// xray_grpc.NewGrpcXrayUnaryClientInterceptor(nil, xray_grpc.WithBackendCount(func(cc *grpc.ClientConn) int {
+//     return myBalancer.ReadyCount(cc.Target())
+// }))
+//
+func WithBackendCount(fn func(cc *grpc.ClientConn) int) Option {
+	return func(o *options) {
+		o.backendCount = fn
+	}
+}
+
+// Returns an Option that makes the unary server interceptor close, and so emit, its segment before returning to
+// grpc-go, even with the stats handler returned by NewStatsHandler, which otherwise delays closing until the response
+// has been sent. Allows integration tests to read a segment as soon as the call returned, at the cost of the
+// response size and encoding, which are not known yet and are not recorded. The subsegments of failed calls held
+// open by WithRetryCoalescing are still emitted once the window elapsed.
+func WithSynchronousEmit(enabled bool) Option {
+	return func(o *options) {
+		o.synchronousEmit = enabled
+	}
+}
+
+// Returns an Option that records the Organization (O) and Organizational Unit (OU) of the client certificate as the
+// grpc.peer_org and grpc.peer_ou annotations on server segments, to attribute calls in a service mesh with mTLS.
+// Complements WithSPIFFEPeerIdentity for certificates without a SPIFFE ID.
+func WithPeerOrganization(enabled bool) Option {
+	return func(o *options) {
+		o.peerOrganization = enabled
+	}
+}
+
+// Returns an Option that makes the server interceptors continue traces from the header fn reads from the incoming
+// metadata, for organisations propagating traces in a format of their own. fn reports whether it found a header, the
+// X-Ray trace header is looked up when it did not. Malformed trace and parent ids are discarded either way.
+// Usage:
+//
+// xray_grpc.WithHeaderParser(func(md metadata.MD) (header.Header, bool) {
+//     values := md.Get("x-acme-trace")
+//     if len(values) == 0 {
+//         return header.Header{}, false
+//     }
+//     return parseAcmeTrace(values[0]), true
+// })
+//
+func WithHeaderParser(fn func(md metadata.MD) (header.Header, bool)) Option {
+	return func(o *options) {
+		o.headerParser = fn
+	}
+}
+
+// Returns an Option that makes the client interceptors write the trace header of their subsegments to the outgoing
+// metadata with fn, which returns the context the call is made with, instead of the X-Ray trace header. The
+// counterpart of WithHeaderParser. Interceptors chained after the client interceptors must keep the metadata fn wrote.
+// Usage:
+//
+// xray_grpc.WithHeaderInjector(func(ctx context.Context, h header.Header) context.Context {
+//     return metadata.AppendToOutgoingContext(ctx, "x-acme-trace", formatAcmeTrace(h))
+// })
+//
+func WithHeaderInjector(fn func(ctx context.Context, h header.Header) context.Context) Option {
+	return func(o *options) {
+		o.headerInjector = fn
+	}
+}
+
+// Returns an Option that records the first incoming metadata value of each key of namespaces on server segments,
+// as metadata under the key (lowercase) in the namespace it maps to. Groups values where they are looked for, e.g.
+// the query id of a gRPC database proxy under "sql". Keys that are absent from a request are skipped.
+// Usage:
+//
+// xray_grpc.WithMetadataNamespaces(map[string]string{"x-query-id": "sql"})
+//
+func WithMetadataNamespaces(namespaces map[string]string) Option {
+	return func(o *options) {
+		o.metadataNamespaces = namespaces
+	}
+}
+
+// Returns an Option that annotates client subsegments of calls leaving the local region with grpc.cross_region, and
+// the regions as grpc.local_region and grpc.remote_region, to highlight costly cross-region hops. fn is called with
+// the target of the connection and reports whether it is in another region.
+// Usage:
+//
+// xray_grpc.WithRegionTagger(func(target string) (string, string, bool) {
+//     remote := regionOf(target)
+//     return localRegion, remote, remote != localRegion
+// })
+//
+func WithRegionTagger(fn func(target string) (localRegion, remoteRegion string, crossed bool)) Option {
+	return func(o *options) {
+		o.regionTagger = fn
+	}
+}
+
+// Returns an Option that annotates server segments of the methods in slo, keyed by full method
+// (/package.Service/Method), with grpc.slo_breach: whether the call took longer than the latency objective of its
+// method, measured from when the call reached the interceptor until the handler returned, on the clock set with
+// WithClock.
+// Usage:
+//
+// xray_grpc.WithMethodSLO(map[string]time.Duration{"/shop.Cart/Checkout": 300 * time.Millisecond})
+//
+func WithMethodSLO(slo map[string]time.Duration) Option {
+	return func(o *options) {
+		o.methodSLO = slo
+	}
+}
+
+// Returns an Option that calls fn with every server segment once the interceptor has populated it, before the call
+// is handled, to enrich it with anything this package does not record. ctx carries the segment, like the context
+// passed to the handler. A panic in fn is logged and does not fail the call. fn must not hold the segment lock while
+// calling segment methods such as AddAnnotation.
+// Usage:
+//
+// xray_grpc.WithOnSegmentStart(func(ctx context.Context, seg *xray.Segment) {
+//     seg.AddAnnotation("tenant", tenantFromContext(ctx))
+// })
+//
+func WithOnSegmentStart(fn func(ctx context.Context, seg *xray.Segment)) Option {
+	return func(o *options) {
+		o.onSegmentStart = fn
+	}
+}
+
+// Returns an Option that calls fn with every server segment and the error returned by the handler (or the
+// pre-handler) once the interceptor has recorded the outcome, right before the segment is closed, as a last chance
+// to annotate it. Not called when something in the chain closed the segment early. A panic in fn is logged and does
+// not fail the call. fn must not hold the segment lock while calling segment methods such as AddAnnotation.
+func WithOnSegmentEnd(fn func(ctx context.Context, seg *xray.Segment, err error)) Option {
+	return func(o *options) {
+		o.onSegmentEnd = fn
+	}
+}
+
+func withEdge() Option {
+	return func(o *options) {
+		o.edge = true
+	}
+}
+
+type logMessage string
+
+func (m logMessage) String() string {
+	return string(m)
+}
+
+func (o *options) warnf(format string, args ...interface{}) {
+	o.logger.Log(xraylog.LogLevelWarn, logMessage(fmt.Sprintf(format, args...)))
+}
+
+// Decides whether the annotators should run for the current call
+func (o *options) sampleAnnotations() bool {
+	if o.annotationSampleRate >= 1 {
+		return true
+	}
+	if o.annotationSampleRate <= 0 {
+		return false
+	}
+	return o.randFloat64() < o.annotationSampleRate
+}
+
+// Returns an Option that makes the stats handler returned by NewStatsHandler trace the server calls grpc-go rejects
+// before any interceptor runs, naming their segments with sn like the server interceptors do. Requests compressed
+// with an encoding the server has no decompressor for are rejected with Unimplemented, their segment records the
+// grpc-encoding sent by the client as grpc.encoding metadata, to tell which legacy clients cause the failures. Any
+// call failing without reaching a server interceptor of this package is traced, so install both the unary and the
+// stream interceptor.
+// Usage:
+//
+// s := grpc.NewServer(grpc.StatsHandler(xray_grpc.NewStatsHandler(xray_grpc.WithRejectedCalls(xray.NewFixedSegmentNamer("my-service")))),
+//                     grpc.UnaryInterceptor(xray_grpc.NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("my-service"))))
+//
+func WithRejectedCalls(sn xray.SegmentNamer) Option {
+	return func(o *options) {
+		o.rejectedCallNamer = sn
+	}
+}
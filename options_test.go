@@ -0,0 +1,272 @@
+package xray_grpc
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/awsplugins/ecs"
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAnnotationSampleRate(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		rand float64
+		want bool
+	}{
+		{"always", 1, 0.99, true},
+		{"never", 0, 0, false},
+		{"below rate", 0.5, 0.49, true},
+		{"at rate", 0.5, 0.5, false},
+		{"above rate", 0.5, 0.9, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests, responses int
+			seg, _, err := serveUnary(context.Background(), nil, nil,
+				WithAnnotationSampleRate(tt.rate),
+				WithRand(func() float64 { return tt.rand }),
+				WithRequestAnnotator(func(context.Context, *xray.Segment, interface{}) { requests++ }),
+				WithResponseAnnotator(func(context.Context, *xray.Segment, interface{}, error) { responses++ }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requests == 1 && responses == 1; got != tt.want {
+				t.Errorf("annotators ran %d/%d times, want them to run: %t", requests, responses, tt.want)
+			}
+			// Basic data is recorded either way
+			if code, _, _, _ := segmentStatus(seg); code != 200 {
+				t.Errorf("status = %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestSamplingStrategy(t *testing.T) {
+	for _, sample := range []bool{true, false} {
+		strategy := &recordingStrategy{sample: sample}
+		seg, _, err := serveUnary(context.Background(), nil, nil, WithSamplingStrategy(strategy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(strategy.requests()) != 1 {
+			t.Errorf("strategy deciding %t consulted %d times, want once", sample, len(strategy.requests()))
+		}
+		if seg.Sampled != sample {
+			t.Errorf("segment sampled: %t, want %t", seg.Sampled, sample)
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	const calls, rate = 1000, 0.25
+	want := 0
+	draws := rand.New(rand.NewSource(7))
+	for i := 0; i < calls; i++ {
+		if draws.Float64() < rate {
+			want++
+		}
+	}
+
+	ctx, emitter := withRecordingEmitter(context.Background())
+	// WithRand is honoured whatever the order of the options
+	interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"),
+		WithSampleRate(rate), WithRand(rand.New(rand.NewSource(7)).Float64))
+	for i := 0; i < calls; i++ {
+		if _, _, err := serveWith(interceptor, ctx, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(emitter.emitted()); got != want {
+		t.Errorf("%d of %d calls emitted, want %d", got, calls, want)
+	}
+
+	// A later strategy replaces the rate
+	seg, _, _ := serveUnary(context.Background(), nil, nil, WithSampleRate(0), WithSamplingStrategy(sampleAll{}))
+	if !seg.Sampled {
+		t.Error("segment not sampled, want the last option to win")
+	}
+	for _, rate := range []float64{0, 1} {
+		seg, _, _ := serveUnary(context.Background(), nil, nil, WithSampleRate(rate), WithRand(func() float64 { return 0.5 }))
+		if seg.Sampled != (rate == 1) {
+			t.Errorf("rate %v: sampled %t", rate, seg.Sampled)
+		}
+	}
+}
+
+// A sampling strategy sampling every request by the rule named rule
+type ruleStrategy struct {
+	rule string
+}
+
+func (s ruleStrategy) ShouldTrace(*sampling.Request) *sampling.Decision {
+	return &sampling.Decision{Sample: true, Rule: &s.rule}
+}
+
+func TestSamplingRuleAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), nil, nil, WithSamplingRuleAnnotation(true), WithSamplingStrategy(ruleStrategy{"orders-api"}))
+	assertAnnotation(t, seg, "xray.sampling_rule", "orders-api")
+
+	// Decisions without a rule, e.g. from the local strategy's default
+	seg, _, _ = serveUnary(context.Background(), nil, nil, WithSamplingRuleAnnotation(true), WithSamplingStrategy(&recordingStrategy{sample: true}))
+	assertNoAnnotation(t, seg, "xray.sampling_rule")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil, WithSamplingStrategy(ruleStrategy{"orders-api"}))
+	assertNoAnnotation(t, seg, "xray.sampling_rule")
+}
+
+func TestInstanceID(t *testing.T) {
+	defer os.Setenv("HOSTNAME", os.Getenv("HOSTNAME"))
+	os.Setenv("HOSTNAME", "replica-7")
+
+	seg, _, _ := serveUnary(context.Background(), nil, nil)
+	assertAnnotation(t, seg, "instance.id", "replica-7")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil, WithInstanceID("replica-1"))
+	assertAnnotation(t, seg, "instance.id", "replica-1")
+}
+
+func TestHTTPMethod(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, GrpcMethod},
+		{"override", []Option{WithHTTPMethod("GET")}, "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, nil, tt.opts...)
+			sub, _ := invokeUnary(context.Background(), newTestConn(t), nil, tt.opts...)
+			for _, s := range []*xray.Segment{seg, sub} {
+				s.RLock()
+				method := s.GetHTTP().GetRequest().Method
+				s.RUnlock()
+				if method != tt.want {
+					t.Errorf("%s: request method = %q, want %q", s.Name, method, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestURLSanitizer(t *testing.T) {
+	redact := func(url string) string { return strings.Replace(url, "/Method", "/{method}", 1) }
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, testMethod},
+		{"sanitized", []Option{WithURLSanitizer(redact)}, "/test.Service/{method}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, nil, tt.opts...)
+			sub, _ := invokeUnary(context.Background(), newTestConn(t), nil, tt.opts...)
+			for _, s := range []*xray.Segment{seg, sub} {
+				s.RLock()
+				url := s.GetHTTP().GetRequest().URL
+				s.RUnlock()
+				if url != tt.want {
+					t.Errorf("%s: URL = %q, want %q", s.Name, url, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreHandler(t *testing.T) {
+	rejected := status.Error(codes.ResourceExhausted, "shedding load")
+	tests := []struct {
+		name       string
+		err        error
+		wantCalled bool
+		wantStatus int
+	}{
+		{"admitted", nil, true, 200},
+		{"rejected", rejected, false, 429},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var preSeg *xray.Segment
+			called := false
+			interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"),
+				WithPreHandler(func(ctx context.Context, seg *xray.Segment, info *grpc.UnaryServerInfo) error {
+					preSeg = seg
+					if info.FullMethod != testMethod {
+						t.Errorf("pre-handler got method %q", info.FullMethod)
+					}
+					return tt.err
+				}))
+			handlerSeg, _, err := serveWith(interceptor, context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+				called = true
+				return "response", nil
+			})
+			if err != tt.err || called != tt.wantCalled {
+				t.Fatalf("err = %v, handler called: %t, want %v, %t", err, called, tt.err, tt.wantCalled)
+			}
+			if preSeg == nil || !segmentClosed(preSeg) {
+				t.Fatal("pre-handler not given the segment, or it was left open")
+			}
+			if handlerSeg != nil && handlerSeg != preSeg {
+				t.Error("pre-handler and handler got different segments")
+			}
+			if code, _, _, _ := segmentStatus(preSeg); code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	clock := func() time.Time { return now }
+	slo := WithMethodSLO(map[string]time.Duration{testMethod: 300 * time.Millisecond})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		now = now.Add(500 * time.Millisecond)
+		return nil, nil
+	}
+	seg, _, _ := serveUnary(context.Background(), nil, handler, slo, WithClock(clock))
+	assertAnnotation(t, seg, "grpc.slo_breach", true)
+
+	// Context deadlines are wall-clock, the fake clock must not skew the remaining budget
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	seg, _, _ = serveUnary(ctx, nil, nil, WithClock(clock))
+	got, _ := annotations(seg)["grpc.timeout_ms"].(float64)
+	if got <= 0 || got > 2000 {
+		t.Errorf("grpc.timeout_ms = %v, want within (0, 2000]", got)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	inits := 0
+	interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithPlugins(func() { inits++ }, ecs.Init))
+	for i := 0; i < 2; i++ {
+		seg, _, err := serveWith(interceptor, context.Background(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg.RLock()
+		origin := seg.Origin
+		seg.RUnlock()
+		if origin != ecs.Origin {
+			t.Errorf("origin = %q, want the one detected by the plugin", origin)
+		}
+	}
+	if inits != 1 {
+		t.Errorf("plugins initialised %d times, want once per interceptor", inits)
+	}
+}
@@ -0,0 +1,55 @@
+package xray_grpc
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Reports whether the connection to p is secured with TLS
+func peerUsesTLS(p *peer.Peer) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok
+}
+
+// Returns the leaf certificate presented by p, nil when the connection is not secured with TLS or p sent none
+func peerCertificate(p *peer.Peer) *x509.Certificate {
+	if p == nil {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+// Returns the Organization (O) and Organizational Unit (OU) of the subject of the certificate presented by p,
+// comma separated when there are several, "" when there is no certificate or it has none
+func peerOrganization(p *peer.Peer) (org, unit string) {
+	cert := peerCertificate(p)
+	if cert == nil {
+		return "", ""
+	}
+	return strings.Join(cert.Subject.Organization, ","), strings.Join(cert.Subject.OrganizationalUnit, ",")
+}
+
+// Returns the SPIFFE ID (spiffe://trust-domain/path) carried in the URI SANs of the certificate presented by p, or
+// "" when there is none
+func peerSPIFFEID(p *peer.Peer) string {
+	cert := peerCertificate(p)
+	if cert == nil {
+		return ""
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package xray_grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestServerTLSAnnotation(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000}
+	tests := []struct {
+		name string
+		peer *peer.Peer
+		want bool
+	}{
+		{"tls", &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{}}, true},
+		{"insecure", &peer.Peer{Addr: addr}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, err := serveUnary(peer.NewContext(context.Background(), tt.peer), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertAnnotation(t, seg, "grpc.tls", tt.want)
+		})
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.tls")
+}
+
+// Returns a peer that presented cert over TLS
+func tlsPeer(cert *x509.Certificate) *peer.Peer {
+	return &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	}
+}
+
+func TestSPIFFEPeerIdentity(t *testing.T) {
+	id, _ := url.Parse("spiffe://cluster.local/ns/orders/sa/api")
+	other, _ := url.Parse("https://orders.example.com")
+	p := tlsPeer(&x509.Certificate{URIs: []*url.URL{other, id}})
+
+	seg, _, _ := serveUnary(peer.NewContext(context.Background(), p), nil, nil, WithSPIFFEPeerIdentity(true))
+	assertAnnotation(t, seg, "grpc.peer_identity", "spiffe://cluster.local/ns/orders/sa/api")
+
+	seg, _, _ = serveUnary(peer.NewContext(context.Background(), tlsPeer(&x509.Certificate{URIs: []*url.URL{other}})), nil, nil, WithSPIFFEPeerIdentity(true))
+	assertNoAnnotation(t, seg, "grpc.peer_identity")
+
+	seg, _, _ = serveUnary(peer.NewContext(context.Background(), p), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.peer_identity")
+}
+
+func TestCapturePeer(t *testing.T) {
+	p := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000}, AuthInfo: credentials.TLSInfo{}}
+	tests := []struct {
+		enabled bool
+		want    string
+	}{
+		{true, "10.0.0.1:51000"},
+		{false, ""},
+	}
+	for _, tt := range tests {
+		seg, _, _ := serveUnary(peer.NewContext(context.Background(), p), nil, nil, WithCapturePeer(tt.enabled))
+		seg.RLock()
+		ip := seg.GetHTTP().GetRequest().ClientIP
+		seg.RUnlock()
+		if ip != tt.want {
+			t.Errorf("enabled: %t, client IP = %q, want %q", tt.enabled, ip, tt.want)
+		}
+		if tt.enabled {
+			assertAnnotation(t, seg, "grpc.tls", true)
+		} else {
+			assertNoAnnotation(t, seg, "grpc.tls")
+		}
+	}
+}
+
+func BenchmarkServerInterceptorPeer(b *testing.B) {
+	p := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000}}
+	ctx := metadata.NewIncomingContext(peer.NewContext(context.Background(), p), metadata.MD{})
+	info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+	handler := func(context.Context, interface{}) (interface{}, error) { return "response", nil }
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("capture=%t", enabled), func(b *testing.B) {
+			// Dropping segments keeps the benchmark from measuring the emitter
+			interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithCapturePeer(enabled), WithShadowMode(true))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				interceptor(ctx, "request", info, handler)
+			}
+		})
+	}
+}
+
+func TestClientIPFromMetadata(t *testing.T) {
+	p := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000}}
+	tests := []struct {
+		name          string
+		md            metadata.MD
+		want          string
+		wantForwarded bool
+	}{
+		{"header", metadata.Pairs("x-real-client-ip", "203.0.113.7", "x-real-client-ip", "10.1.1.1"), "203.0.113.7", true},
+		{"no header", metadata.Pairs("x-forwarded-for", "203.0.113.7"), "10.0.0.1:51000", false},
+	}
+	for _, tt := range tests {
+		seg, _, _ := serveUnary(peer.NewContext(context.Background(), p), tt.md, nil, WithClientIPFromMetadata("X-Real-Client-IP"))
+		seg.RLock()
+		req := seg.GetHTTP().GetRequest()
+		ip, forwarded := req.ClientIP, req.XForwardedFor
+		seg.RUnlock()
+		if ip != tt.want || forwarded != tt.wantForwarded {
+			t.Errorf("%s: client IP = %q, forwarded: %t, want %q, %t", tt.name, ip, forwarded, tt.want, tt.wantForwarded)
+		}
+	}
+}
+
+func TestPeerOrganization(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{Organization: []string{"Acme"}, OrganizationalUnit: []string{"orders", "billing"}}}
+	ctx := peer.NewContext(context.Background(), tlsPeer(cert))
+
+	seg, _, _ := serveUnary(ctx, nil, nil, WithPeerOrganization(true))
+	assertAnnotation(t, seg, "grpc.peer_org", "Acme")
+	assertAnnotation(t, seg, "grpc.peer_ou", "orders,billing")
+
+	seg, _, _ = serveUnary(peer.NewContext(context.Background(), tlsPeer(&x509.Certificate{})), nil, nil, WithPeerOrganization(true))
+	assertNoAnnotation(t, seg, "grpc.peer_org")
+	assertNoAnnotation(t, seg, "grpc.peer_ou")
+
+	insecure := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51000}}
+	seg, _, _ = serveUnary(peer.NewContext(context.Background(), insecure), nil, nil, WithPeerOrganization(true))
+	assertNoAnnotation(t, seg, "grpc.peer_org")
+
+	seg, _, _ = serveUnary(ctx, nil, nil)
+	assertNoAnnotation(t, seg, "grpc.peer_org")
+}
@@ -0,0 +1,150 @@
+package xray_grpc
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/metadata"
+)
+
+// Returns the trace header a call made with ctx from seg is sent with. Calls made while handling a call in shadow
+// mode are marked not sampled, their parent is never sent to X-Ray. The caller must hold the lock of seg.
+func downstreamHeader(ctx context.Context, seg *xray.Segment) header.Header {
+	h := *seg.DownstreamHeader()
+	if inShadowMode(ctx) {
+		h.SamplingDecision = header.NotSampled
+	}
+	return h
+}
+
+// Writes the downstream trace header of seg to the outgoing metadata of ctx, see
+// https://github.com/grpc/grpc-go/blob/master/Documentation/grpc-metadata.md
+// Other outgoing metadata is kept, a trace header already present is replaced. The caller must hold the lock of seg.
+func injectTraceHeader(ctx context.Context, seg *xray.Segment) context.Context {
+	h := downstreamHeader(ctx, seg)
+	value := h.String()
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok || len(md.Get(xray.TraceIDHeaderKey)) == 0 {
+		return metadata.AppendToOutgoingContext(ctx, xray.TraceIDHeaderKey, value)
+	}
+	// Left by an outer interceptor or copied from the incoming call, the server would continue from the stale one
+	md = md.Copy()
+	md.Set(xray.TraceIDHeaderKey, value)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// Per-RPC credentials sending the trace header when the outgoing metadata that reaches the transport lacks it, e.g.
+// because an interceptor chained after the client interceptor replaced it with metadata.NewOutgoingContext
+type traceHeaderCredentials struct {
+	value string
+}
+
+func (c traceHeaderCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	// Sending the header twice would be harmless, but noisy
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(xray.TraceIDHeaderKey)) > 0 {
+		return nil, nil
+	}
+	return map[string]string{xray.TraceIDHeaderKey: c.value}, nil
+}
+
+func (traceHeaderCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Reads the trace header sent by injectTraceHeader from incoming metadata. The second return value reports whether
+// a header was present at all.
+func extractTraceHeader(md metadata.MD) (*header.Header, bool) {
+	// Assume Metadata Key only has one value. Lookups are case insensitive, metadata translated by a gRPC-Web proxy
+	// such as Envoy arrives as x-amzn-trace-id
+	traceString := strings.TrimSpace(firstMetadataValue(md, xray.TraceIDHeaderKey))
+	// Browser clients may URL-encode the header value (Root%3D1-...%3BParent%3D...)
+	if strings.Contains(traceString, "%") {
+		if decoded, err := url.PathUnescape(traceString); err == nil {
+			traceString = decoded
+		}
+	}
+	h := header.FromString(traceString)
+	// header.FromString accepts any value
+	clearInvalidIDs(h)
+	return h, traceString != ""
+}
+
+// Returns the trace header the server continues from, read with the parser set with WithHeaderParser when it
+// found one, with extractTraceHeader otherwise
+func (o *options) incomingTraceHeader(md metadata.MD) *header.Header {
+	if o.headerParser != nil {
+		if h, ok := o.headerParser(md); ok {
+			clearInvalidIDs(&h)
+			return &h
+		}
+	}
+	h, _ := extractTraceHeader(md)
+	return h
+}
+
+// Clears the ids of h that are malformed, X-Ray would reject segments continuing from them
+func clearInvalidIDs(h *header.Header) {
+	if !traceIDPattern.MatchString(h.TraceID) {
+		h.TraceID, h.ParentID = "", ""
+	}
+	if !parentIDPattern.MatchString(h.ParentID) {
+		h.ParentID = ""
+	}
+}
+
+// Formats of the ids in X-Ray trace headers, see
+// https://docs.aws.amazon.com/xray/latest/devguide/xray-api-sendingdata.html#xray-api-traceids
+var (
+	traceIDPattern  = regexp.MustCompile(`^1-[0-9a-f]{8}-[0-9a-f]{24}$`)
+	parentIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// Simulates a traced call from a client whose current segment is seg to a server, passing the trace header through
+// an in-memory metadata map exactly like NewGrpcXrayUnaryClientInterceptor and NewGrpcXrayUnaryServerInterceptor do.
+// Returns the header the server would continue the trace from, and whether one was received. Intended for unit
+// testing propagation logic without wiring up two interceptors and a connection.
+func InjectAndExtractRoundTrip(ctx context.Context, seg *xray.Segment) (header.Header, bool) {
+	seg.Lock()
+	ctx = injectTraceHeader(ctx, seg)
+	seg.Unlock()
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	h, ok := extractTraceHeader(md.Copy())
+	return *h, ok
+}
+
+// Returns the trailers sent with WithTraceTrailers for a server call traced by seg
+func traceTrailer(seg *xray.Segment) metadata.MD {
+	return metadata.Pairs("x-xray-trace-id", seg.TraceID, "x-xray-segment-id", seg.ID)
+}
+
+type traceIDKey struct{}
+
+// Returns the X-Ray trace id of the request being handled, for correlating logs with traces. By default only
+// sampled requests, whose trace can be looked up in X-Ray, expose their id. With WithAlwaysPropagateContext the id
+// of unsampled requests is available as well. Returns "" when ctx does not derive from a context passed to a
+// handler by NewGrpcXrayUnaryServerInterceptor.
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+type sampledKey struct{}
+
+// Returns whether the request being handled is sampled, i.e. whether its trace is sent to X-Ray, so logs can tell
+// requests with a trace apart from unsampled ones. ok is false when ctx does not derive from a context passed to a
+// handler by NewGrpcXrayUnaryServerInterceptor or NewGrpcXrayStreamServerInterceptor.
+// Usage:
+//
+// if sampled, ok := xray_grpc.SampledFromContext(ctx); ok {
+//     logger = logger.With("xray_sampled", sampled)
+// }
+//
+func SampledFromContext(ctx context.Context) (sampled, ok bool) {
+	sampled, ok = ctx.Value(sampledKey{}).(bool)
+	return sampled, ok
+}
@@ -0,0 +1,15 @@
+//go:build go1.18
+// +build go1.18
+
+package xray_grpc
+
+import "testing"
+
+func FuzzExtractTraceHeader(f *testing.F) {
+	for _, value := range traceHeaderCorpus {
+		f.Add(value)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		checkTraceHeader(t, value)
+	})
+}
@@ -0,0 +1,418 @@
+package xray_grpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestInjectAndExtractRoundTrip(t *testing.T) {
+	ctx, seg := xray.BeginSegment(context.Background(), "test")
+	defer seg.Close(nil)
+	_, sub := xray.BeginSubsegment(ctx, "downstream")
+	defer sub.Close(nil)
+
+	for _, s := range []*xray.Segment{seg, sub} {
+		h, ok := InjectAndExtractRoundTrip(ctx, s)
+		if !ok {
+			t.Fatalf("%s: no trace header received", s.Name)
+		}
+		if h.TraceID != seg.TraceID || h.ParentID != s.ID || h.SamplingDecision != header.Sampled {
+			t.Errorf("%s: received %+v, want trace %s continued from %s", s.Name, h, seg.TraceID, s.ID)
+		}
+	}
+}
+
+func TestAlwaysPropagateContext(t *testing.T) {
+	md := metadata.Pairs(xray.TraceIDHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8")
+	for _, enabled := range []bool{true, false} {
+		ctx, emitter := withRecordingEmitter(context.Background())
+		var traceID string
+		_, _, err := serveUnary(ctx, md, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			traceID = TraceIDFromContext(ctx)
+			return nil, nil
+		}, WithAlwaysPropagateContext(enabled), WithSamplingStrategy(&recordingStrategy{sample: false}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if enabled {
+			want = "1-5759e988-bd862e3fe1be46a994272793"
+		}
+		if traceID != want {
+			t.Errorf("WithAlwaysPropagateContext(%t): TraceIDFromContext() = %q, want %q", enabled, traceID, want)
+		}
+		if segs := emitter.emitted(); len(segs) != 0 {
+			t.Errorf("WithAlwaysPropagateContext(%t): emitted %d unsampled segments", enabled, len(segs))
+		}
+	}
+}
+
+func TestGRPCWebTraceHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"plain", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"},
+		{"url encoded", "Root%3D1-5759e988-bd862e3fe1be46a994272793%3BParent%3D53995c3f42cd8ad8%3BSampled%3D1"},
+		{"padded", "  Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Envoy's gRPC-Web filter forwards HTTP headers as metadata under their lowercase name
+			seg, _, err := serveUnary(context.Background(), metadata.MD{"x-amzn-trace-id": {tt.value}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.TraceID != "1-5759e988-bd862e3fe1be46a994272793" || seg.ParentID != "53995c3f42cd8ad8" {
+				t.Errorf("continued trace %s from %s, want the browser's", seg.TraceID, seg.ParentID)
+			}
+		})
+	}
+}
+
+func TestInjectTraceHeaderMergesOutgoingMetadata(t *testing.T) {
+	var sub *xray.Segment
+	var received metadata.MD
+	capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		sub = xray.GetSegment(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	srv := &testServer{unary: func(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		received, _ = metadata.FromIncomingContext(ctx)
+		return &testpb.SimpleResponse{}, nil
+	}}
+	client := startTestServer(t, srv,
+		[]grpc.ServerOption{grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test")))},
+		grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil), capture))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	// A stale header, e.g. copied from the incoming call, must be replaced
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant-id", "acme",
+		xray.TraceIDHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := received.Get("x-tenant-id"); len(got) != 1 || got[0] != "acme" {
+		t.Errorf("x-tenant-id = %q, want the caller's metadata kept", got)
+	}
+	if got := received.Get(xray.TraceIDHeaderKey); len(got) != 1 {
+		t.Errorf("trace headers received: %q, want exactly one", got)
+	}
+	if seg := srv.segment(); seg.TraceID != root.TraceID || seg.ParentID != sub.ID {
+		t.Errorf("server continued trace %s from %s, want %s from %s", seg.TraceID, seg.ParentID, root.TraceID, sub.ID)
+	}
+}
+
+func TestTraceHeaderSurvivesChainedInterceptors(t *testing.T) {
+	var sub *xray.Segment
+	capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		sub = xray.GetSegment(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	// Replaces the outgoing metadata, trace header included, as careless interceptors do
+	rewrite := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.NewOutgoingContext(ctx, metadata.Pairs("x-tenant-id", "acme")), method, req, reply, cc, opts...)
+	}
+	var received metadata.MD
+	srv := &testServer{unary: func(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		received, _ = metadata.FromIncomingContext(ctx)
+		return &testpb.SimpleResponse{}, nil
+	}}
+	client := startTestServer(t, srv,
+		[]grpc.ServerOption{grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test")))},
+		grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil), capture, rewrite))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := received.Get("x-tenant-id"); len(got) != 1 || got[0] != "acme" {
+		t.Errorf("x-tenant-id = %q, want the rewritten metadata", got)
+	}
+	if got := received.Get(xray.TraceIDHeaderKey); len(got) != 1 {
+		t.Errorf("trace headers received: %q, want exactly one", got)
+	}
+	if seg := srv.segment(); seg.TraceID != root.TraceID || seg.ParentID != sub.ID {
+		t.Errorf("server continued trace %s from %s, want %s from %s", seg.TraceID, seg.ParentID, root.TraceID, sub.ID)
+	}
+}
+
+func TestTraceHeaderSurvivesChainedStreamInterceptors(t *testing.T) {
+	var sub *xray.Segment
+	rewrite := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		sub = xray.GetSegment(ctx)
+		return streamer(metadata.NewOutgoingContext(ctx, metadata.MD{}), desc, cc, method, opts...)
+	}
+	srv := &testServer{}
+	client := startTestServer(t, srv,
+		[]grpc.ServerOption{grpc.StreamInterceptor(NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test")))},
+		grpc.WithChainStreamInterceptor(NewGrpcXrayStreamClientInterceptor(nil), rewrite))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	stream, err := client.FullDuplexCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v, want io.EOF", err)
+	}
+
+	if seg := srv.segment(); seg.TraceID != root.TraceID || seg.ParentID != sub.ID {
+		t.Errorf("server continued trace %s from %s, want %s from %s", seg.TraceID, seg.ParentID, root.TraceID, sub.ID)
+	}
+}
+
+func TestTraceTrailers(t *testing.T) {
+	srv := &testServer{}
+	client := startTestServer(t, srv, []grpc.ServerOption{
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithTraceTrailers(true))),
+		grpc.StreamInterceptor(NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithTraceTrailers(true))),
+	})
+
+	var trailer metadata.MD
+	if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	assertTraceTrailer(t, trailer, srv.segment())
+
+	stream, err := client.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v, want io.EOF", err)
+	}
+	assertTraceTrailer(t, stream.Trailer(), srv.segment())
+}
+
+// Fails t unless trailer carries the trace and segment ids of seg
+func assertTraceTrailer(t *testing.T, trailer metadata.MD, seg *xray.Segment) {
+	t.Helper()
+	if got := trailer.Get("x-xray-trace-id"); len(got) != 1 || got[0] != seg.TraceID {
+		t.Errorf("x-xray-trace-id = %q, want %s", got, seg.TraceID)
+	}
+	if got := trailer.Get("x-xray-segment-id"); len(got) != 1 || got[0] != seg.ID {
+		t.Errorf("x-xray-segment-id = %q, want %s", got, seg.ID)
+	}
+}
+
+func TestParentIDAnnotation(t *testing.T) {
+	md := metadata.Pairs(xray.TraceIDHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	seg, _, _ := serveUnary(context.Background(), md, nil)
+	assertAnnotation(t, seg, "xray.parent_id", "53995c3f42cd8ad8")
+
+	// A malformed parent is not continued from, nor recorded
+	md = metadata.Pairs(xray.TraceIDHeaderKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=oops;Sampled=1")
+	seg, _, _ = serveUnary(context.Background(), md, nil)
+	assertNoAnnotation(t, seg, "xray.parent_id")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "xray.parent_id")
+}
+
+// Seed corpus for extractTraceHeader. The module targets Go 1.16, which has no native fuzzing, so the corpus and
+// mutations of it derived from a fixed seed are run as a table. FuzzExtractTraceHeader uses it on Go 1.18 and later.
+var traceHeaderCorpus = []string{
+	"",
+	"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+	"Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=?",
+	"Root%3D1-5759e988-bd862e3fe1be46a994272793%3BParent%3D53995c3f42cd8ad8",
+	"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1;Self=1-abc;Lineage=a:1",
+	"Root=;Parent=;Sampled=",
+	"Root=1-ZZZZZZZZ-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8",
+	"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8ff",
+	";;;===;;;",
+	"%zz%",
+	"%00Root=1",
+	"Root=1-5759e988-bd862e3fe1be46a994272793\x00;Parent=53995c3f42cd8ad8",
+	"\xff\xfe\xfd",
+	strings.Repeat("Root=1;", 1000),
+}
+
+func TestExtractTraceHeaderCorpus(t *testing.T) {
+	values := append([]string(nil), traceHeaderCorpus...)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		seed := []byte(traceHeaderCorpus[r.Intn(len(traceHeaderCorpus))])
+		for n := r.Intn(8); n >= 0 && len(seed) > 0; n-- {
+			seed[r.Intn(len(seed))] = byte(r.Intn(256))
+		}
+		values = append(values, string(seed))
+	}
+
+	for _, value := range values {
+		checkTraceHeader(t, value)
+	}
+}
+
+// Checks that a trace header value yields ids X-Ray accepts and a segment that can be emitted
+func checkTraceHeader(t *testing.T, value string) {
+	h, _ := extractTraceHeader(metadata.MD{xray.TraceIDHeaderKey: {value}})
+	if h.TraceID != "" && !traceIDPattern.MatchString(h.TraceID) || h.ParentID != "" && !parentIDPattern.MatchString(h.ParentID) {
+		t.Errorf("%q: extracted invalid ids %+v", value, h)
+	}
+
+	seg, _, err := serveUnary(context.Background(), metadata.MD{xray.TraceIDHeaderKey: {value}}, nil)
+	if err != nil {
+		t.Fatalf("%q: %v", value, err)
+	}
+	if !traceIDPattern.MatchString(seg.TraceID) || !parentIDPattern.MatchString(seg.ID) ||
+		seg.ParentID != "" && !parentIDPattern.MatchString(seg.ParentID) {
+		t.Errorf("%q: segment with trace %q, id %q and parent %q would be rejected", value, seg.TraceID, seg.ID, seg.ParentID)
+	}
+	seg.RLock()
+	_, err = json.Marshal(seg)
+	seg.RUnlock()
+	if err != nil {
+		t.Errorf("%q: segment can not be emitted: %v", value, err)
+	}
+}
+
+func TestHeaderParser(t *testing.T) {
+	// Reads "<trace id>/<parent id>" from a bespoke header
+	parser := WithHeaderParser(func(md metadata.MD) (header.Header, bool) {
+		values := md.Get("x-acme-trace")
+		if len(values) == 0 {
+			return header.Header{}, false
+		}
+		parts := strings.SplitN(values[0], "/", 2)
+		h := header.Header{TraceID: parts[0], SamplingDecision: header.Sampled}
+		if len(parts) == 2 {
+			h.ParentID = parts[1]
+		}
+		return h, true
+	})
+	const traceID, parentID = "1-5759e988-bd862e3fe1be46a994272793", "53995c3f42cd8ad8"
+	xrayHeader := "Root=1-6acf2496-248bc640da8c84ca4f9d076c;Parent=dc679988ee8162fc;Sampled=1"
+	tests := []struct {
+		name                  string
+		md                    metadata.MD
+		wantTrace, wantParent string
+	}{
+		{"bespoke header", metadata.Pairs("x-acme-trace", traceID+"/"+parentID, xray.TraceIDHeaderKey, xrayHeader), traceID, parentID},
+		{"fallback", metadata.Pairs(xray.TraceIDHeaderKey, xrayHeader), "1-6acf2496-248bc640da8c84ca4f9d076c", "dc679988ee8162fc"},
+		{"malformed parent", metadata.Pairs("x-acme-trace", traceID+"/not-an-id"), traceID, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), tt.md, nil, parser)
+			if seg.TraceID != tt.wantTrace || seg.ParentID != tt.wantParent {
+				t.Errorf("continued trace %s from %q, want %s from %q", seg.TraceID, seg.ParentID, tt.wantTrace, tt.wantParent)
+			}
+		})
+	}
+
+	// A malformed trace id starts a new trace
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("x-acme-trace", "acme-42/"+parentID), nil, parser)
+	if !traceIDPattern.MatchString(seg.TraceID) || seg.ParentID != "" {
+		t.Errorf("continued trace %s from %q, want a new trace", seg.TraceID, seg.ParentID)
+	}
+}
+
+func TestHeaderInjector(t *testing.T) {
+	injector := WithHeaderInjector(func(ctx context.Context, h header.Header) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "x-acme-trace", h.TraceID+"/"+h.ParentID)
+	})
+	var received metadata.MD
+	srv := &testServer{unary: func(ctx context.Context, _ *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		received, _ = metadata.FromIncomingContext(ctx)
+		return &testpb.SimpleResponse{}, nil
+	}}
+	var sub *xray.Segment
+	capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		sub = xray.GetSegment(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	client := startTestServer(t, srv, nil, grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil, injector), capture))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := received.Get("x-acme-trace"), root.TraceID+"/"+sub.ID; len(got) != 1 || got[0] != want {
+		t.Errorf("x-acme-trace = %q, want %q", got, want)
+	}
+	// Neither injected nor sent as a fallback
+	if got := received.Get(xray.TraceIDHeaderKey); len(got) != 0 {
+		t.Errorf("X-Ray trace header = %q, want none with a custom injector", got)
+	}
+}
+
+func TestDownstreamHeaderMetadata(t *testing.T) {
+	var received metadata.MD
+	srv := &testServer{unary: func(ctx context.Context, _ *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		received, _ = metadata.FromIncomingContext(ctx)
+		return &testpb.SimpleResponse{}, nil
+	}}
+	var sub *xray.Segment
+	capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		sub = xray.GetSegment(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	client := startTestServer(t, srv, nil, grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil), capture))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	sent := received.Get(xray.TraceIDHeaderKey)
+	if got := metadataOf(sub)["xray.downstream_header"]; len(sent) != 1 || got != sent[0] {
+		t.Errorf("xray.downstream_header = %v, want the header the server received %q", got, sent)
+	}
+
+	// A custom injector writes a header of its own
+	injected, _ := invokeUnary(context.Background(), newTestConn(t), nil, WithHeaderInjector(func(ctx context.Context, _ header.Header) context.Context {
+		return ctx
+	}))
+	if got := metadataOf(injected)["xray.downstream_header"]; got != nil {
+		t.Errorf("xray.downstream_header = %v, want none with a custom injector", got)
+	}
+}
+
+func TestSampledFromContext(t *testing.T) {
+	for _, sample := range []bool{true, false} {
+		var sampled, ok bool
+		_, _, err := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			sampled, ok = SampledFromContext(ctx)
+			return nil, nil
+		}, WithSamplingStrategy(&recordingStrategy{sample: sample}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sampled != sample || !ok {
+			t.Errorf("SampledFromContext() = %t, %t, want %t, true", sampled, ok, sample)
+		}
+
+		interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithSamplingStrategy(&recordingStrategy{sample: sample}))
+		ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+		interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(_ interface{}, stream grpc.ServerStream) error {
+			sampled, ok = SampledFromContext(stream.Context())
+			return nil
+		})
+		if sampled != sample || !ok {
+			t.Errorf("stream: SampledFromContext() = %t, %t, want %t, true", sampled, ok, sample)
+		}
+	}
+
+	if sampled, ok := SampledFromContext(context.Background()); sampled || ok {
+		t.Errorf("SampledFromContext() = %t, %t outside a handler, want false, false", sampled, ok)
+	}
+}
@@ -0,0 +1,24 @@
+package xray_grpc
+
+import (
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+)
+
+// Samples a fixed fraction of calls, see WithSampleRate
+type rateSamplingStrategy struct {
+	rate float64
+	rand func() float64
+}
+
+func (s *rateSamplingStrategy) ShouldTrace(*sampling.Request) *sampling.Decision {
+	var sample bool
+	switch {
+	case s.rate >= 1:
+		sample = true
+	case s.rate <= 0:
+		sample = false
+	default:
+		sample = s.rand() < s.rate
+	}
+	return &sampling.Decision{Sample: sample}
+}
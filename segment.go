@@ -0,0 +1,236 @@
+package xray_grpc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// The parts of an X-Ray (sub)segment the status, annotation and metadata helpers use, so their interactions can be
+// tested against a mock. xraySegment adapts *xray.Segment, fields are read and written behind the unexported
+// accessors, which lock the segment themselves.
+type segment interface {
+	AddAnnotation(key string, value interface{}) error
+	AddMetadata(key string, value interface{}) error
+	AddMetadataToNamespace(namespace string, key string, value interface{}) error
+
+	// Name of the (sub)segment, for log messages
+	segmentName() string
+	// Keys of the annotations set so far, in no particular order
+	annotationKeys() []string
+	removeAnnotation(key string)
+	setResponseStatus(code int)
+	setError()
+	setFault()
+	setThrottle()
+	// Records err as an exception without flagging the segment
+	recordException(err error)
+}
+
+// Adapts *xray.Segment to segment
+type xraySegment struct {
+	*xray.Segment
+}
+
+var _ segment = xraySegment{}
+
+func (s xraySegment) segmentName() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Name
+}
+
+func (s xraySegment) annotationKeys() []string {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]string, 0, len(s.Annotations))
+	for key := range s.Annotations {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s xraySegment) removeAnnotation(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.Annotations, key)
+}
+
+func (s xraySegment) setResponseStatus(code int) {
+	s.Lock()
+	defer s.Unlock()
+	s.GetHTTP().GetResponse().Status = code
+}
+
+func (s xraySegment) setError() {
+	s.Lock()
+	defer s.Unlock()
+	s.Error = true
+}
+
+func (s xraySegment) setFault() {
+	s.Lock()
+	defer s.Unlock()
+	s.Fault = true
+}
+
+func (s xraySegment) setThrottle() {
+	s.Lock()
+	defer s.Unlock()
+	s.Throttle = true
+}
+
+func (s xraySegment) recordException(err error) {
+	s.Lock()
+	defer s.Unlock()
+	addException(s.Segment, err)
+}
+
+// Returns a copy of ctx whose X-Ray recorder configuration (see xray.ContextWithConfig) has been modified by fn.
+// Segments created from the returned context, and their subsegments, pick up the modified configuration.
+func contextWithConfig(ctx context.Context, fn func(cfg *xray.Config)) context.Context {
+	cfg := xray.Config{}
+	if existing := xray.GetRecorder(ctx); existing != nil {
+		cfg = *existing
+	}
+	fn(&cfg)
+	return context.WithValue(ctx, xray.RecorderContextKey{}, &cfg)
+}
+
+// Longest (sub)segment name X-Ray accepts
+const maxSegmentNameLength = 200
+
+// Removes the characters X-Ray does not accept in (sub)segment names, anything but letters, numbers, spaces and
+// _ . : / % & # = + \ - @, and truncates name to 200 characters. X-Ray drops segments with invalid names.
+func sanitizeSegmentName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.In(r, unicode.Z) || strings.ContainsRune(`_.:/%&#=+\-@`, r) {
+			return r
+		}
+		return -1
+	}, name)
+	if runes := []rune(name); len(runes) > maxSegmentNameLength {
+		name = string(runes[:maxSegmentNameLength])
+	}
+	return name
+}
+
+// Returns the name of the sampling rule the SDK recorded when deciding whether to sample seg, "" when the decision
+// was made without a rule, e.g. taken from the trace header
+func samplingRuleName(seg *xray.Segment) string {
+	seg.Lock()
+	defer seg.Unlock()
+	if sdk, ok := seg.GetAWS()["xray"].(xray.SDK); ok {
+		return sdk.RuleName
+	}
+	return ""
+}
+
+// Reports whether seg has already been closed, e.g. by a misbehaving interceptor or handler
+func segmentClosed(seg *xray.Segment) bool {
+	seg.RLock()
+	defer seg.RUnlock()
+	return seg.EndTime > 0
+}
+
+// Limits X-Ray puts on annotations, see
+// https://docs.aws.amazon.com/xray/latest/devguide/xray-api-segmentdocuments.html#api-segmentdocuments-annotations
+const (
+	maxAnnotationKeyLength   = 500
+	maxAnnotationValueLength = 1000
+)
+
+// Adds an annotation to seg, logging values the SDK rejects. Keys and string values over the X-Ray limits are
+// truncated rather than having the whole segment document rejected. New keys are dropped once seg has the maximum
+// number of annotations set with WithMaxAnnotations. seg must not be locked by the caller.
+func (o *options) addAnnotation(seg segment, key string, value interface{}) {
+	if len(key) > maxAnnotationKeyLength {
+		key = key[:maxAnnotationKeyLength]
+	}
+	if o.maxAnnotations > 0 {
+		keys := seg.annotationKeys()
+		if len(keys) >= o.maxAnnotations && !containsString(keys, key) {
+			o.warnf("xray_grpc: segment %q has %d annotations, dropping %s", seg.segmentName(), o.maxAnnotations, key)
+			return
+		}
+	}
+	if s, ok := value.(string); ok && len(s) > maxAnnotationValueLength {
+		value = s[:maxAnnotationValueLength]
+	}
+	if err := seg.AddAnnotation(key, value); err != nil {
+		o.warnf("xray_grpc: %v", err)
+	}
+}
+
+// Runs annotate, an annotator adding annotations to seg directly, then drops the annotations it added beyond the
+// maximum set with WithMaxAnnotations. Annotations seg had before are kept, new ones are kept in key order so the
+// same ones are dropped every time. seg must not be locked by the caller.
+func (o *options) capAnnotations(seg segment, annotate func()) {
+	if o.maxAnnotations <= 0 {
+		annotate()
+		return
+	}
+
+	before := map[string]bool{}
+	for _, key := range seg.annotationKeys() {
+		before[key] = true
+	}
+
+	annotate()
+
+	keys := seg.annotationKeys()
+	excess := len(keys) - o.maxAnnotations
+	if excess <= 0 {
+		return
+	}
+	var added []string
+	for _, key := range keys {
+		if !before[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	if excess > len(added) {
+		excess = len(added)
+	}
+	dropped := added[len(added)-excess:]
+	for _, key := range dropped {
+		seg.removeAnnotation(key)
+	}
+	if len(dropped) > 0 {
+		o.warnf("xray_grpc: segment %q exceeded %d annotations, dropped %v", seg.segmentName(), o.maxAnnotations, dropped)
+	}
+}
+
+// Adds metadata to seg, logging failures. seg must not be locked by the caller.
+func (o *options) addMetadata(seg segment, key string, value interface{}) {
+	if err := seg.AddMetadata(key, value); err != nil {
+		o.warnf("xray_grpc: %v", err)
+	}
+}
+
+// Like addMetadata, storing the value in namespace ns instead of the SDK's default namespace
+func (o *options) addMetadataToNamespace(seg segment, ns, key string, value interface{}) {
+	if err := seg.AddMetadataToNamespace(ns, key, value); err != nil {
+		o.warnf("xray_grpc: %v", err)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,277 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSanitizeSegmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"my-service", "my-service"},
+		{"orders.svc:3000/Get", "orders.svc:3000/Get"},
+		{"my service", "my service"},
+		{"my<service>!", "myservice"},
+		{"tab\tnew\nline\r", "tabnewline"},
+		{"café", "café"},
+		{"no\u00a0break", "no\u00a0break"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeSegmentName(tt.name); got != tt.want {
+			t.Errorf("sanitizeSegmentName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("é", 2*maxSegmentNameLength)
+	if got := sanitizeSegmentName(long); utf8.RuneCountInString(got) != maxSegmentNameLength || !utf8.ValidString(got) {
+		t.Errorf("long name sanitized to %d runes, want %d", utf8.RuneCountInString(got), maxSegmentNameLength)
+	}
+}
+
+func TestNameSanitizer(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), nil, nil, WithSegmentNameTemplate("{service}\t<{method}>"))
+	if seg.Name != "test.ServiceMethod" {
+		t.Errorf("segment name = %q, want it sanitized by default", seg.Name)
+	}
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil, WithNameSanitizer(strings.ToUpper))
+	sub, _ := invokeUnary(context.Background(), newTestConn(t), nil, WithNameSanitizer(strings.ToUpper))
+	if seg.Name != "TEST" || sub.Name != "MY-SERVICE.MY-NAMESPACE.LOCAL" {
+		t.Errorf("named %q and %q, want the custom sanitizer applied to both", seg.Name, sub.Name)
+	}
+}
+
+func TestMaxAnnotations(t *testing.T) {
+	logger := &recordingLogger{}
+	o := newOptions([]Option{WithMaxAnnotations(2), WithLogger(logger)})
+	seg := &mockSegment{}
+	for _, key := range []string{"first", "second", "third"} {
+		o.addAnnotation(seg, key, 1)
+	}
+	// Updating a kept annotation is not adding one
+	o.addAnnotation(seg, "first", 2)
+	if got := seg.annotations; len(got) != 2 || got["first"] != 2 || got["second"] != 1 {
+		t.Errorf("annotations = %v, want first and second", got)
+	}
+	if len(logger.logged()) != 1 {
+		t.Errorf("logged %q, want a warning about the dropped annotation", logger.logged())
+	}
+}
+
+func TestMaxAnnotationsFromAnnotator(t *testing.T) {
+	keys := []string{"k09", "k03", "k07", "k00", "k05", "k01", "k08", "k02", "k06", "k04"}
+	annotator := WithRequestAnnotator(func(_ context.Context, seg *xray.Segment, _ interface{}) {
+		for _, key := range keys {
+			seg.AddAnnotation(key, true)
+		}
+	})
+	baseline, _, _ := serveUnary(context.Background(), nil, nil)
+	max := len(annotations(baseline)) + 3
+
+	for i := 0; i < 3; i++ {
+		logger := &recordingLogger{}
+		seg, _, _ := serveUnary(context.Background(), nil, nil, annotator, WithMaxAnnotations(max), WithLogger(logger))
+		got := annotations(seg)
+		if len(got) != max {
+			t.Errorf("%d annotations, want the cap of %d", len(got), max)
+		}
+		// The annotator's keys are kept in key order
+		kept := 0
+		for kept < len(keys) && got[fmt.Sprintf("k%02d", kept)] != nil {
+			kept++
+		}
+		for _, key := range keys {
+			if _, ok := got[key]; ok && key >= fmt.Sprintf("k%02d", kept) {
+				t.Errorf("kept %s after dropping k%02d", key, kept)
+			}
+		}
+		if kept == 0 || kept == len(keys) {
+			t.Errorf("kept %d of the annotator's annotations, want some dropped", kept)
+		}
+		if len(logger.logged()) == 0 {
+			t.Error("nothing logged, want a warning about the dropped annotations")
+		}
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, nil, annotator, WithMaxAnnotations(0))
+	if got := len(annotations(seg)); got != len(annotations(baseline))+len(keys) {
+		t.Errorf("%d annotations without a cap, want all the annotator's", got)
+	}
+}
+
+// A segment recording what the helpers do to it, its SDK methods failing with err
+type mockSegment struct {
+	err                                error
+	annotations                        map[string]interface{}
+	metadata                           map[string]interface{}
+	status                             int
+	errorFlag, faultFlag, throttleFlag bool
+	exceptions                         []error
+}
+
+func (s *mockSegment) AddAnnotation(key string, value interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.annotations == nil {
+		s.annotations = map[string]interface{}{}
+	}
+	s.annotations[key] = value
+	return nil
+}
+
+func (s *mockSegment) AddMetadata(key string, value interface{}) error {
+	return s.AddMetadataToNamespace("default", key, value)
+}
+
+func (s *mockSegment) AddMetadataToNamespace(namespace string, key string, value interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.metadata == nil {
+		s.metadata = map[string]interface{}{}
+	}
+	s.metadata[namespace+"."+key] = value
+	return nil
+}
+
+func (s *mockSegment) segmentName() string { return "mock" }
+
+func (s *mockSegment) annotationKeys() []string {
+	var keys []string
+	for key := range s.annotations {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *mockSegment) removeAnnotation(key string) { delete(s.annotations, key) }
+func (s *mockSegment) setResponseStatus(code int)  { s.status = code }
+func (s *mockSegment) setError()                   { s.errorFlag = true }
+func (s *mockSegment) setFault()                   { s.faultFlag = true }
+func (s *mockSegment) setThrottle()                { s.throttleFlag = true }
+func (s *mockSegment) recordException(err error)   { s.exceptions = append(s.exceptions, err) }
+
+func TestRecordStatus(t *testing.T) {
+	tests := []struct {
+		name                    string
+		err                     error
+		flag                    bool
+		wantStatus              int
+		wantError, wantFault    bool
+		wantThrottle, wantCause bool
+	}{
+		{"ok", nil, true, 200, false, false, false, false},
+		{"not found", status.Error(codes.NotFound, "no such order"), true, 404, true, false, false, true},
+		{"exhausted", status.Error(codes.ResourceExhausted, "slow down"), true, 429, true, false, true, true},
+		{"internal", status.Error(codes.Internal, "boom"), true, 500, false, true, false, true},
+		{"expected error", status.Error(codes.Internal, "boom"), false, 500, false, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg := &mockSegment{}
+			newOptions(nil).recordStatus(seg, tt.err, tt.flag)
+			if seg.status != tt.wantStatus || seg.errorFlag != tt.wantError || seg.faultFlag != tt.wantFault || seg.throttleFlag != tt.wantThrottle {
+				t.Errorf("status %d, error %v, fault %v, throttle %v, want %d, %v, %v, %v",
+					seg.status, seg.errorFlag, seg.faultFlag, seg.throttleFlag, tt.wantStatus, tt.wantError, tt.wantFault, tt.wantThrottle)
+			}
+			if got := len(seg.exceptions) == 1 && seg.exceptions[0] == tt.err; got != tt.wantCause {
+				t.Errorf("exceptions = %v, want the error recorded: %v", seg.exceptions, tt.wantCause)
+			}
+		})
+	}
+
+	seg := &mockSegment{}
+	newOptions([]Option{WithDisableHTTPStatus(true)}).recordStatus(seg, status.Error(codes.NotFound, ""), true)
+	if seg.status != 0 || seg.annotations["grpc.status_code"] != "NotFound" || !seg.errorFlag {
+		t.Errorf("status %d, annotations %v, error %v, want the code annotated instead of the status", seg.status, seg.annotations, seg.errorFlag)
+	}
+}
+
+func TestRecordOutcome(t *testing.T) {
+	seg := &mockSegment{}
+	newOptions(nil).recordOutcome(seg, status.Error(codes.DeadlineExceeded, "too slow"), true)
+	want := map[string]interface{}{
+		"error.class":        errorClass(codes.DeadlineExceeded),
+		"grpc.outcome":       outcome(codes.DeadlineExceeded),
+		"grpc.cancel_origin": "deadline",
+	}
+	if !reflect.DeepEqual(seg.annotations, want) {
+		t.Errorf("annotations = %v, want %v", seg.annotations, want)
+	}
+	if seg.metadata["default.grpc.status_text"] != httpStatusText(504) || seg.status != 504 || !seg.faultFlag {
+		t.Errorf("metadata %v, status %d, fault %v, want the status recorded", seg.metadata, seg.status, seg.faultFlag)
+	}
+}
+
+func TestAddAnnotation(t *testing.T) {
+	logger := &recordingLogger{}
+	o := newOptions([]Option{WithLogger(logger)})
+	seg := &mockSegment{}
+	o.addAnnotation(seg, strings.Repeat("k", 2*maxAnnotationKeyLength), strings.Repeat("v", 2*maxAnnotationValueLength))
+	for key, value := range seg.annotations {
+		if len(key) != maxAnnotationKeyLength || len(value.(string)) != maxAnnotationValueLength {
+			t.Errorf("annotation of %d and %d bytes, want them truncated to the X-Ray limits", len(key), len(value.(string)))
+		}
+	}
+	if len(logger.logged()) != 0 {
+		t.Errorf("logged %q, want nothing", logger.logged())
+	}
+
+	seg = &mockSegment{err: errors.New("segment closed")}
+	o.addAnnotation(seg, "grpc.tls", true)
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "segment closed") {
+		t.Errorf("logged %q, want the SDK error", logged)
+	}
+}
+
+func TestCapAnnotations(t *testing.T) {
+	logger := &recordingLogger{}
+	o := newOptions([]Option{WithMaxAnnotations(3), WithLogger(logger)})
+	seg := &mockSegment{annotations: map[string]interface{}{"kept": 1}}
+	o.capAnnotations(seg, func() {
+		for _, key := range []string{"d", "b", "c", "a"} {
+			seg.AddAnnotation(key, 1)
+		}
+	})
+	want := map[string]interface{}{"kept": 1, "a": 1, "b": 1}
+	if !reflect.DeepEqual(seg.annotations, want) {
+		t.Errorf("annotations = %v, want %v", seg.annotations, want)
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "[c d]") {
+		t.Errorf("logged %q, want the dropped keys", logged)
+	}
+}
+
+func TestAddMetadata(t *testing.T) {
+	logger := &recordingLogger{}
+	o := newOptions([]Option{WithLogger(logger)})
+	seg := &mockSegment{}
+	o.addMetadata(seg, "grpc.encoding", "gzip")
+	o.addMetadataToNamespace(seg, "http", "request_headers", "x-tenant-id")
+	want := map[string]interface{}{"default.grpc.encoding": "gzip", "http.request_headers": "x-tenant-id"}
+	if !reflect.DeepEqual(seg.metadata, want) {
+		t.Errorf("metadata = %v, want %v", seg.metadata, want)
+	}
+	if len(logger.logged()) != 0 {
+		t.Errorf("logged %q, want nothing", logger.logged())
+	}
+
+	seg = &mockSegment{err: errors.New("segment closed")}
+	o.addMetadata(seg, "grpc.encoding", "gzip")
+	o.addMetadataToNamespace(seg, "http", "request_headers", "x-tenant-id")
+	if logged := logger.logged(); len(logged) != 2 || !strings.Contains(logged[0], "segment closed") {
+		t.Errorf("logged %q, want a warning per failure", logged)
+	}
+}
@@ -0,0 +1,268 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Creates and populates the segment for a server call to fullMethod from the trace header in the incoming metadata.
+// Returns a nil segment when the call should not be traced.
+func (o *options) beginServerSegment(ctx context.Context, sn xray.SegmentNamer, fullMethod string) (context.Context, *xray.Segment, error) {
+	// Tells the stats handler the call was not rejected before reaching the interceptors
+	if w := wireStatsFromContext(ctx); w != nil && !w.client {
+		w.Lock()
+		w.intercepted = true
+		w.Unlock()
+	}
+	if tracingDisabled(ctx) {
+		return ctx, nil, nil
+	}
+
+	// See https://github.com/grpc/grpc-go/blob/master/Documentation/grpc-metadata.md
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx, nil, errors.New("unable to read metadata")
+	}
+
+	// Like the SDK's HTTP handler, let the namer see the host the client called
+	name := sn.Name(requestHost(md))
+	if o.segmentNameTemplate != "" {
+		name = expandSegmentNameTemplate(o.segmentNameTemplate, fullMethod)
+	}
+	name = o.nameSanitizer(name)
+
+	traceHeader := o.incomingTraceHeader(md)
+
+	// At the edge, let the SDK evaluate sampling rules against the call instead of only the service name
+	var r *http.Request
+	if o.edge {
+		r = &http.Request{
+			Method: o.httpMethod,
+			Host:   requestHost(md),
+			URL:    &url.URL{Path: fullMethod},
+		}
+	}
+
+	if o.samplingStrategy != nil || o.shadowMode || o.emitter != nil {
+		ctx = contextWithConfig(ctx, func(cfg *xray.Config) {
+			if o.samplingStrategy != nil {
+				cfg.SamplingStrategy = o.samplingStrategy
+			}
+			if o.emitter != nil {
+				cfg.Emitter = o.emitter
+			}
+			if o.shadowMode {
+				cfg.Emitter = discardEmitter{}
+			}
+		})
+	}
+
+	// Copy Segment creation from X-Ray SDK: https://github.com/aws/aws-xray-sdk-go/blob/master/xray/segment.go
+	ctx, seg := xray.NewSegmentFromHeader(ctx, name, r, traceHeader)
+	// Not expected from the SDK, but the interceptors handle a nil segment by calling the handler untraced
+	if seg == nil {
+		return ctx, nil, nil
+	}
+	if o.shadowMode {
+		ctx = withShadowMode(ctx)
+	}
+	ctx = withSubsegmentTracker(ctx)
+	ctx = withDuplicateMarker(ctx)
+	// Makes the depth of call chains visible, clients forward the incremented count
+	ctx, hop := withHop(ctx, md)
+	if seg.Sampled || o.alwaysPropagateContext {
+		ctx = context.WithValue(ctx, traceIDKey{}, seg.TraceID)
+	}
+	ctx = context.WithValue(ctx, sampledKey{}, seg.Sampled)
+
+	seg.Lock()
+
+	ClientIP := ""
+	var p *peer.Peer
+	if o.capturePeer {
+		p, _ = peer.FromContext(ctx)
+	}
+	if p != nil {
+		ClientIP = p.Addr.String()
+	}
+	// Behind a proxy the peer is the proxy, like X-Forwarded-For for HTTP
+	forwarded := false
+	if o.clientIPMetadataKey != "" {
+		if ip := firstMetadataValue(md, o.clientIPMetadataKey); ip != "" {
+			ClientIP = ip
+			forwarded = true
+		}
+	}
+
+	reqData := &xray.RequestData{
+		Method:        o.httpMethod,
+		URL:           o.urlSanitizer(fullMethod),
+		ClientIP:      ClientIP,
+		UserAgent:     CustomUserAgent,
+		XForwardedFor: forwarded,
+	}
+
+	seg.GetHTTP().Request = reqData
+
+	seg.Unlock()
+
+	if p != nil {
+		o.addAnnotation(xraySegment{seg}, "grpc.tls", peerUsesTLS(p))
+	}
+	if o.spiffePeerIdentity {
+		if id := peerSPIFFEID(p); id != "" {
+			o.addAnnotation(xraySegment{seg}, "grpc.peer_identity", id)
+		}
+	}
+	if o.peerOrganization {
+		org, unit := peerOrganization(p)
+		if org != "" {
+			o.addAnnotation(xraySegment{seg}, "grpc.peer_org", org)
+		}
+		if unit != "" {
+			o.addAnnotation(xraySegment{seg}, "grpc.peer_ou", unit)
+		}
+	}
+	o.addAnnotation(xraySegment{seg}, "grpc.hop", hop)
+	// The parent the caller claimed, to debug links missing from the service map
+	if traceHeader.ParentID != "" {
+		o.addAnnotation(xraySegment{seg}, "xray.parent_id", traceHeader.ParentID)
+	}
+	o.annotatePackage(seg, fullMethod)
+	// Keeps ids of correlation schemes predating X-Ray searchable
+	if correlationID := firstMetadataValue(md, "x-correlation-id"); correlationID != "" {
+		o.addAnnotation(xraySegment{seg}, "correlation.id", correlationID)
+	}
+	// Compares versions during canaries, when routing by version
+	if version := firstMetadataValue(md, "x-service-version"); version != "" {
+		o.addAnnotation(xraySegment{seg}, "grpc.service_version", version)
+	}
+	// Correlates the priority callers tag calls with to their latency
+	if priority := firstMetadataValue(md, "x-priority"); priority != "" {
+		o.addAnnotation(xraySegment{seg}, "grpc.priority", priority)
+	}
+	if o.localeAnnotation {
+		if locale := firstMetadataValue(md, "accept-language"); locale != "" {
+			o.addAnnotation(xraySegment{seg}, "grpc.locale", locale)
+		}
+	}
+	if o.idempotencyAnnotation {
+		o.addAnnotation(xraySegment{seg}, "grpc.idempotent", len(md.Get(idempotencyKeyMetadataKey)) > 0)
+	}
+	if o.samplingRuleAnnotation {
+		if rule := samplingRuleName(seg); rule != "" {
+			o.addAnnotation(xraySegment{seg}, "xray.sampling_rule", rule)
+		}
+	}
+	if o.instanceID != "" {
+		o.addAnnotation(xraySegment{seg}, "instance.id", o.instanceID)
+	}
+	if o.metadataCount {
+		o.addAnnotation(xraySegment{seg}, "grpc.metadata_count", len(md))
+	}
+	if o.metadataBytes {
+		o.addAnnotation(xraySegment{seg}, "grpc.metadata_bytes", metadataSize(md))
+	}
+	if len(o.requestHeaders) > 0 {
+		if headers := metadataSubset(md, o.requestHeaders); len(headers) > 0 {
+			o.addMetadataToNamespace(xraySegment{seg}, "http", "request_headers", headers)
+		}
+	}
+	for key, ns := range o.metadataNamespaces {
+		if value := firstMetadataValue(md, key); value != "" {
+			o.addMetadataToNamespace(xraySegment{seg}, ns, strings.ToLower(key), value)
+		}
+	}
+	// Tells native gRPC (application/grpc) apart from gRPC-Web translated by a proxy
+	if contentType := firstMetadataValue(md, "content-type"); contentType != "" {
+		o.addMetadata(xraySegment{seg}, "grpc.content_type", contentType)
+	}
+
+	// Verbatim, unlike grpc.request_encoding which is only recorded with a stats handler
+	if encoding := requestEncoding(ctx, md); encoding != "" {
+		o.addMetadata(xraySegment{seg}, "grpc.encoding", encoding)
+	}
+
+	// grpc-go consumes grpc-timeout before it reaches the metadata, fall back to the deadline it was turned into
+	timeout := firstMetadataValue(md, "grpc-timeout")
+	if deadline, ok := ctx.Deadline(); ok && timeout == "" {
+		timeout = encodeTimeout(time.Until(deadline))
+	}
+	if timeout != "" {
+		o.addAnnotation(xraySegment{seg}, "grpc.timeout", timeout)
+		if d, err := decodeTimeout(timeout); err == nil {
+			o.addAnnotation(xraySegment{seg}, "grpc.timeout_ms", float64(d)/float64(time.Millisecond))
+		} else {
+			o.warnf("xray_grpc: %v", err)
+		}
+	}
+
+	if o.onSegmentStart != nil {
+		o.runHook("WithOnSegmentStart", func() { o.onSegmentStart(ctx, seg) })
+	}
+
+	return ctx, seg, nil
+}
+
+// Returns the host the client addressed, from the :authority pseudo header or, for requests translated by an
+// HTTP/1 proxy, the host header
+func requestHost(md metadata.MD) string {
+	if host := firstMetadataValue(md, ":authority"); host != "" {
+		return host
+	}
+	return firstMetadataValue(md, "host")
+}
+
+// Records the outcome of a server call handled with ctx on its segment, start is when the call started on the clock
+// set with WithClock. Returns false, without touching the segment, when there is no segment or something in the
+// chain already closed it.
+func (o *options) endServerSegment(ctx context.Context, seg *xray.Segment, fullMethod string, start time.Time, err error) bool {
+	if seg == nil {
+		return false
+	}
+	// Something in the chain closed the segment early, mutating it now would corrupt emitted data
+	if segmentClosed(seg) {
+		o.warnf("xray_grpc: segment %q was closed before %s returned, skipping response data", seg.Name, fullMethod)
+		return false
+	}
+
+	o.recordOutcome(xraySegment{seg}, err, true)
+	o.recordDeadline(ctx, seg, err)
+	if threshold, ok := o.methodSLO[fullMethod]; ok {
+		o.addAnnotation(xraySegment{seg}, "grpc.slo_breach", o.now().Sub(start) > threshold)
+	}
+	if markedDuplicate(ctx) {
+		o.addAnnotation(xraySegment{seg}, "grpc.duplicate", true)
+	}
+	if o.businessCode {
+		if bc := businessCode(err); bc != "" {
+			o.addAnnotation(xraySegment{seg}, "business.code", bc)
+		}
+	}
+
+	return true
+}
+
+// Returns the error a server interceptor hands back to grpc-go for err, with the trace id appended to its message
+// when WithTraceIDInError is enabled
+func (o *options) serverError(seg *xray.Segment, err error) error {
+	if err == nil || !o.traceIDInError || seg == nil || seg.TraceID == "" {
+		return err
+	}
+	return withTraceID(err, seg.TraceID)
+}
+
+// Closes seg unless something in the chain already did, or there is no segment
+func closeServerSegment(seg *xray.Segment) {
+	if seg != nil && !segmentClosed(seg) {
+		seg.Close(nil)
+	}
+}
@@ -0,0 +1,214 @@
+package xray_grpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestServerSegmentClosedByHandler(t *testing.T) {
+	logger := &recordingLogger{}
+	seg, _, err := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		xray.GetSegment(ctx).Close(nil)
+		return nil, status.Error(codes.Internal, "boom")
+	}, WithLogger(logger))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("err = %v, want the handler error", err)
+	}
+	if code, fault, _, _ := segmentStatus(seg); code != 0 || fault {
+		t.Errorf("closed segment got status %d, fault %t, want it untouched", code, fault)
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "was closed before") {
+		t.Errorf("logged %q, want a warning about the closed segment", logged)
+	}
+}
+
+func TestMetadataCountAnnotation(t *testing.T) {
+	md := metadata.Pairs("x-tenant-id", "acme", "x-request-id", "1", "x-request-id", "2", "content-type", "application/grpc")
+	seg, _, _ := serveUnary(context.Background(), md, nil, WithMetadataCount(true))
+	assertAnnotation(t, seg, "grpc.metadata_count", 3)
+
+	seg, _, _ = serveUnary(context.Background(), md, nil)
+	assertNoAnnotation(t, seg, "grpc.metadata_count")
+}
+
+func TestTraceIDInError(t *testing.T) {
+	failing := func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such order")
+	}
+	seg, _, err := serveUnary(context.Background(), nil, failing, WithTraceIDInError(true))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("code = %v, want the handler's NotFound", status.Code(err))
+	}
+	if got, want := status.Convert(err).Message(), "no such order [trace: "+seg.TraceID+"]"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+
+	_, _, err = serveUnary(context.Background(), nil, failing)
+	if got := status.Convert(err).Message(); got != "no such order" {
+		t.Errorf("message = %q, want it unchanged by default", got)
+	}
+	if _, _, err := serveUnary(context.Background(), nil, nil, WithTraceIDInError(true)); err != nil {
+		t.Errorf("err = %v, want successful calls to stay successful", err)
+	}
+}
+
+func TestSegmentNamerGetsHost(t *testing.T) {
+	tests := []struct {
+		name string
+		sn   xray.SegmentNamer
+		md   metadata.MD
+		want string
+	}{
+		{"fixed", xray.NewFixedSegmentNamer("orders"), metadata.Pairs(":authority", "orders.example.com"), "orders"},
+		{"dynamic match", xray.NewDynamicSegmentNamer("fallback", "*.example.com"), metadata.Pairs(":authority", "orders.example.com"), "orders.example.com"},
+		{"dynamic fallback", xray.NewDynamicSegmentNamer("fallback", "*.example.com"), metadata.Pairs(":authority", "orders.internal"), "fallback"},
+		{"host header", xray.NewDynamicSegmentNamer("fallback", "*.example.com"), metadata.Pairs("host", "web.example.com"), "web.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, err := serveWith(NewGrpcXrayUnaryServerInterceptor(tt.sn), context.Background(), tt.md, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg.Name != tt.want {
+				t.Errorf("segment name = %q, want %q", seg.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTypeMetadata(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("content-type", "application/grpc-web+proto"), nil)
+	if got := metadataOf(seg)["grpc.content_type"]; got != "application/grpc-web+proto" {
+		t.Errorf("grpc.content_type = %v, want the incoming content-type", got)
+	}
+}
+
+func TestServerUnsampledSegment(t *testing.T) {
+	opts := []Option{
+		WithSamplingStrategy(&recordingStrategy{sample: false}),
+		WithMessageCounts(true),
+		WithResponseAnnotator(func(_ context.Context, seg *xray.Segment, _ interface{}, _ error) { seg.AddAnnotation("custom", true) }),
+	}
+	failure := status.Error(codes.Internal, "boom")
+	seg, _, err := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, failure
+	}, opts...)
+	if err != failure {
+		t.Errorf("err = %v, want the handler error", err)
+	}
+	if seg == nil || seg.Sampled {
+		t.Fatalf("handler ran with %v, want an unsampled segment", seg)
+	}
+
+	srv := &testServer{}
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), opts...)
+	fullDuplex(t, startTestServer(t, srv, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)}), "ping")
+	if seg := srv.segment(); seg == nil || seg.Sampled {
+		t.Errorf("stream handled with %v, want an unsampled segment", seg)
+	}
+}
+
+func TestEmptyResponseAnnotation(t *testing.T) {
+	tests := []struct {
+		name string
+		resp interface{}
+		err  error
+		want bool
+	}{
+		{"nil", nil, nil, true},
+		{"typed nil", (*testpb.SimpleResponse)(nil), nil, true},
+		{"response", &testpb.SimpleResponse{}, nil, false},
+		{"error", nil, status.Error(codes.Internal, "boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+				return tt.resp, tt.err
+			}, WithEmptyResponseAnnotation(true))
+			if tt.want {
+				assertAnnotation(t, seg, "grpc.empty_response", true)
+			} else {
+				assertNoAnnotation(t, seg, "grpc.empty_response")
+			}
+		})
+	}
+}
+
+func TestLocaleAnnotation(t *testing.T) {
+	md := metadata.Pairs("accept-language", "fr-CH, fr;q=0.9", "accept-language", "en")
+	seg, _, _ := serveUnary(context.Background(), md, nil, WithLocaleAnnotation(true))
+	assertAnnotation(t, seg, "grpc.locale", "fr-CH, fr;q=0.9")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil, WithLocaleAnnotation(true))
+	assertNoAnnotation(t, seg, "grpc.locale")
+}
+
+func TestCorrelationIDAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("x-correlation-id", "legacy-4711"), nil)
+	assertAnnotation(t, seg, "correlation.id", "legacy-4711")
+
+	seg, _, _ = serveUnary(context.Background(), metadata.Pairs("x-correlation-id", ""), nil)
+	assertNoAnnotation(t, seg, "correlation.id")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "correlation.id")
+}
+
+func TestServiceVersionAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("x-service-version", "v2", "x-service-version", "v1"), nil)
+	assertAnnotation(t, seg, "grpc.service_version", "v2")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.service_version")
+}
+
+func TestPriorityAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("x-priority", "high", "x-priority", "low"), nil)
+	assertAnnotation(t, seg, "grpc.priority", "high")
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.priority")
+}
+
+func TestMethodSLO(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := WithClock(func() time.Time { return now })
+	slo := WithMethodSLO(map[string]time.Duration{testMethod: 300 * time.Millisecond})
+	taking := func(d time.Duration) grpc.UnaryHandler {
+		return func(context.Context, interface{}) (interface{}, error) {
+			now = now.Add(d)
+			return nil, nil
+		}
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, taking(500*time.Millisecond), slo, clock)
+	assertAnnotation(t, seg, "grpc.slo_breach", true)
+	seg, _, _ = serveUnary(context.Background(), nil, taking(50*time.Millisecond), slo, clock)
+	assertAnnotation(t, seg, "grpc.slo_breach", false)
+
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), slo, clock)
+	ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(_ interface{}, stream grpc.ServerStream) error {
+		seg = xray.GetSegment(stream.Context())
+		now = now.Add(time.Second)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnnotation(t, seg, "grpc.slo_breach", true)
+
+	// Methods without an objective
+	seg, _, _ = serveUnary(context.Background(), nil, taking(time.Second), WithMethodSLO(map[string]time.Duration{"/other.Service/Method": time.Millisecond}), clock)
+	assertNoAnnotation(t, seg, "grpc.slo_breach")
+}
@@ -0,0 +1,243 @@
+package xray_grpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/stats"
+)
+
+type wireStatsKey struct{}
+
+// What the stats handler returned by NewStatsHandler observed on the wire for one call
+type wireStats struct {
+	sync.Mutex
+	wireSnapshot
+
+	// Whether a stats handler has seen the call, the stats are meaningless otherwise
+	tagged bool
+	// Deposited by a client interceptor for its call, rather than created by the stats handler
+	client bool
+
+	// Full method of a server call, and whether a server interceptor of this package saw it
+	method      string
+	intercepted bool
+
+	// Server segment whose closing waits for the response to be sent
+	pending     *xray.Segment
+	pendingOpts *options
+	ended       bool
+
+	// When a client call began, to time its first response header
+	begin time.Time
+	now   func() time.Time
+}
+
+// Inbound and outbound sizes and encodings of a call, from the point of view of the side that observed them
+type wireSnapshot struct {
+	in, out                 int
+	inEncoding, outEncoding string
+
+	// Time from the start of a client call to the response header, 0 until it was received
+	ttfb time.Duration
+	// User-agent of a client call, as sent by the transport
+	userAgent string
+}
+
+func wireStatsFromContext(ctx context.Context) *wireStats {
+	w, _ := ctx.Value(wireStatsKey{}).(*wireStats)
+	return w
+}
+
+// Returns a context for a client call whose wire stats the stats handler can report back to the interceptor, now
+// is the clock durations are measured with
+func withWireStats(ctx context.Context, now func() time.Time) (context.Context, *wireStats) {
+	w := &wireStats{now: now, client: true}
+	return context.WithValue(ctx, wireStatsKey{}, w), w
+}
+
+// Returns the stats observed so far, ok is false when no stats handler saw the call
+func (w *wireStats) snapshot() (snap wireSnapshot, ok bool) {
+	if w == nil {
+		return wireSnapshot{}, false
+	}
+	w.Lock()
+	defer w.Unlock()
+	return w.wireSnapshot, w.tagged
+}
+
+// Closes seg once the call ended, so the response sent after the interceptor returned is included
+func (w *wireStats) closeAfterEnd(o *options, seg *xray.Segment) {
+	w.Lock()
+	if !w.ended {
+		w.pending = seg
+		w.pendingOpts = o
+		w.Unlock()
+		return
+	}
+	snap := w.wireSnapshot
+	w.Unlock()
+
+	o.recordWireStats(seg, snap, false)
+	closeServerSegment(seg)
+}
+
+type statsHandler struct {
+	o *options
+}
+
+// Returns a stats.Handler that observes calls on the wire for the interceptors of this package, which then record
+// the size of messages on the wire (compressed, signed, encrypted) as content length, rather than computing
+// message sizes themselves, and the negotiated compression of each direction. Client subsegments also get the time
+// to the response header as grpc.ttfb_ms. When registered on a server, unary segments are closed once the response
+// has been sent. opts only matter with WithRejectedCalls, which traces the server calls grpc-go rejects before any
+// interceptor runs.
+// Usage:
+//
+// s := grpc.NewServer(grpc.StatsHandler(xray_grpc.NewStatsHandler()),
+//                     grpc.UnaryInterceptor(xray_grpc.NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("my-service"))))
+//
+func NewStatsHandler(opts ...Option) stats.Handler {
+	return &statsHandler{o: newServerOptions(opts)}
+}
+
+func (h *statsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	// Client interceptors deposit the stats before the call reaches the stats handler. Calls made from a handler
+	// inherit the stats of the server call, which must not be counted twice.
+	w := wireStatsFromContext(ctx)
+	if w == nil || !w.client {
+		w = &wireStats{now: time.Now, method: info.FullMethodName}
+		ctx = context.WithValue(ctx, wireStatsKey{}, w)
+	}
+	w.Lock()
+	w.tagged = true
+	w.Unlock()
+	return ctx
+}
+
+func (h *statsHandler) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	w := wireStatsFromContext(ctx)
+	if w == nil {
+		return
+	}
+
+	switch rs := rs.(type) {
+	case *stats.Begin:
+		if rs.Client {
+			w.Lock()
+			// Rather than rs.BeginTime, so both ends are measured with the same clock
+			w.begin = w.now()
+			w.Unlock()
+		}
+	case *stats.InHeader:
+		w.Lock()
+		w.inEncoding = rs.Compression
+		// InHeader carries no timestamp, it is handled as soon as the header is read
+		if rs.Client && !w.begin.IsZero() && w.ttfb == 0 {
+			w.ttfb = w.now().Sub(w.begin)
+		}
+		w.Unlock()
+	case *stats.OutHeader:
+		w.Lock()
+		w.outEncoding = rs.Compression
+		if rs.Client {
+			w.userAgent = firstMetadataValue(rs.Header, "user-agent")
+		}
+		w.Unlock()
+	case *stats.InPayload:
+		w.Lock()
+		w.in += rs.WireLength
+		w.Unlock()
+	case *stats.OutPayload:
+		w.Lock()
+		w.out += rs.WireLength
+		w.Unlock()
+	case *stats.End:
+		if rs.Client {
+			return
+		}
+		w.Lock()
+		w.ended = true
+		seg, o := w.pending, w.pendingOpts
+		snap := w.wireSnapshot
+		rejected := !w.intercepted && rs.Error != nil
+		w.Unlock()
+
+		if seg != nil {
+			o.recordWireStats(seg, snap, false)
+			closeServerSegment(seg)
+		}
+		if rejected && h.o.rejectedCallNamer != nil {
+			h.o.traceRejectedCall(ctx, w.method, snap.inEncoding, rs)
+		}
+	}
+}
+
+// Traces a server call grpc-go rejected before any interceptor ran, e.g. because it has no decompressor for the
+// request encoding, in a segment recording the encoding as sent by the client and the status of the rejection
+func (o *options) traceRejectedCall(ctx context.Context, fullMethod, encoding string, end *stats.End) {
+	ctx, seg, err := o.beginServerSegment(ctx, o.rejectedCallNamer, fullMethod)
+	if err != nil || seg == nil {
+		return
+	}
+	seg.Lock()
+	seg.StartTime = float64(end.BeginTime.UnixNano()) / float64(time.Second)
+	seg.Unlock()
+	if encoding != "" {
+		o.addMetadata(xraySegment{seg}, "grpc.encoding", encoding)
+	}
+	if o.endServerSegment(ctx, seg, fullMethod, o.now(), end.Error) {
+		closeServerSegment(seg)
+	}
+}
+
+func (h *statsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *statsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// Records wire stats on seg, client tells which side of the call seg belongs to. seg must not be locked.
+func (o *options) recordWireStats(seg *xray.Segment, snap wireSnapshot, client bool) {
+	request, response := snap.in, snap.out
+	requestEncoding, responseEncoding := snap.inEncoding, snap.outEncoding
+	if client {
+		request, response = response, request
+		requestEncoding, responseEncoding = responseEncoding, requestEncoding
+	}
+
+	o.recordPayloadSizes(seg, request, response)
+	if segmentClosed(seg) {
+		return
+	}
+	o.addAnnotation(xraySegment{seg}, "grpc.request_encoding", encodingName(requestEncoding))
+	o.addAnnotation(xraySegment{seg}, "grpc.response_encoding", encodingName(responseEncoding))
+	// Separates server think time from the transfer of the response
+	if client && snap.ttfb > 0 {
+		o.addAnnotation(xraySegment{seg}, "grpc.ttfb_ms", float64(snap.ttfb)/float64(time.Millisecond))
+	}
+	if client && o.userAgentMetadata && snap.userAgent != "" {
+		o.addMetadata(xraySegment{seg}, "grpc.user_agent", snap.userAgent)
+	}
+}
+
+// Records the request size as metadata and the response size as content length. seg must not be locked.
+func (o *options) recordPayloadSizes(seg *xray.Segment, request, response int) {
+	if segmentClosed(seg) {
+		return
+	}
+	seg.Lock()
+	seg.GetHTTP().GetResponse().ContentLength = response
+	seg.Unlock()
+	o.addMetadata(xraySegment{seg}, "grpc.request_content_length", request)
+}
+
+// Uncompressed messages carry no encoding
+func encodingName(compression string) string {
+	if compression == "" {
+		return "identity"
+	}
+	return compression
+}
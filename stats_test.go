@@ -0,0 +1,168 @@
+package xray_grpc
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestStatsHandlerKeepsDownstreamCallsApart(t *testing.T) {
+	downstream := startTestServer(t, &testServer{}, nil, grpc.WithStatsHandler(NewStatsHandler()))
+	big := &testpb.Payload{Body: bytes.Repeat([]byte("x"), 10000)}
+
+	srv := &testServer{unary: func(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+		// Untraced, through a connection with a stats handler of its own
+		if _, err := downstream.UnaryCall(ctx, &testpb.SimpleRequest{Payload: big}); err != nil {
+			return nil, err
+		}
+		return &testpb.SimpleResponse{Payload: req.Payload}, nil
+	}}
+	client := startTestServer(t, srv, []grpc.ServerOption{
+		grpc.StatsHandler(NewStatsHandler()),
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"))),
+	})
+	if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{Payload: &testpb.Payload{Body: []byte("ping")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	seg := srv.segment()
+	waitClosed(t, seg)
+	seg.RLock()
+	response := seg.GetHTTP().GetResponse().ContentLength
+	seg.RUnlock()
+	request, _ := metadataOf(seg)["grpc.request_content_length"].(int)
+	if request == 0 || request > 100 || response == 0 || response > 100 {
+		t.Errorf("request %d and response %d bytes, want only the few bytes of the traced call", request, response)
+	}
+}
+
+func TestStatsHandlerAsymmetricEncodings(t *testing.T) {
+	var sub *xray.Segment
+	capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		sub = xray.GetSegment(ctx)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	srv := &testServer{}
+	client := startTestServer(t, srv, []grpc.ServerOption{
+		grpc.StatsHandler(NewStatsHandler()),
+		// Compresses responses whatever the request used
+		grpc.RPCCompressor(grpc.NewGZIPCompressor()),
+		grpc.UnaryInterceptor(NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"))),
+	}, grpc.WithStatsHandler(NewStatsHandler()), grpc.WithDecompressor(grpc.NewGZIPDecompressor()),
+		grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil), capture))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{Payload: &testpb.Payload{Body: []byte("ping")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	seg := srv.segment()
+	waitClosed(t, seg)
+	for _, s := range []*xray.Segment{seg, sub} {
+		assertAnnotation(t, s, "grpc.request_encoding", "identity")
+		assertAnnotation(t, s, "grpc.response_encoding", "gzip")
+	}
+}
+
+func TestStatsHandlerTimeToFirstByte(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	h := NewStatsHandler()
+
+	// Drives the stats events grpc-go would report for the call
+	sub, err := invokeUnary(context.Background(), newTestConn(t), func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: testMethod})
+		h.HandleRPC(ctx, &stats.Begin{Client: true})
+		now = now.Add(25 * time.Millisecond)
+		h.HandleRPC(ctx, &stats.InHeader{Client: true})
+		now = now.Add(100 * time.Millisecond)
+		h.HandleRPC(ctx, &stats.InHeader{Client: true})
+		h.HandleRPC(ctx, &stats.End{Client: true})
+		return nil
+	}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnnotation(t, sub, "grpc.ttfb_ms", float64(25))
+
+	// Without a stats handler the time is not known
+	sub, _ = invokeUnary(context.Background(), newTestConn(t), nil)
+	assertNoAnnotation(t, sub, "grpc.ttfb_ms")
+}
+
+func TestUserAgentMetadata(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var sub *xray.Segment
+		capture := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			sub = xray.GetSegment(ctx)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		var received string
+		srv := &testServer{unary: func(ctx context.Context, _ *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			received = firstMetadataValue(md, "user-agent")
+			return &testpb.SimpleResponse{}, nil
+		}}
+		client := startTestServer(t, srv, nil, grpc.WithUserAgent("orders-client/1.0"), grpc.WithStatsHandler(NewStatsHandler()),
+			grpc.WithChainUnaryInterceptor(NewGrpcXrayUnaryClientInterceptor(nil, WithUserAgentMetadata(enabled)), capture))
+
+		ctx, root := xray.BeginSegment(context.Background(), "test")
+		if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		root.Close(nil)
+
+		got := metadataOf(sub)["grpc.user_agent"]
+		if enabled && (got != received || !strings.HasPrefix(received, "orders-client/1.0 grpc-go/")) {
+			t.Errorf("grpc.user_agent = %v, want %q the server received", got, received)
+		}
+		if !enabled && got != nil {
+			t.Errorf("grpc.user_agent = %v, want none by default", got)
+		}
+	}
+}
+
+// Delays reporting the end of calls to a stats handler, as a busy server may
+type slowEndHandler struct {
+	stats.Handler
+}
+
+func (h slowEndHandler) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	if _, ok := rs.(*stats.End); ok {
+		time.Sleep(100 * time.Millisecond)
+	}
+	h.Handler.HandleRPC(ctx, rs)
+}
+
+func TestSynchronousEmit(t *testing.T) {
+	ctx, emitter := withRecordingEmitter(context.Background())
+	useEmitter := func(c context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(contextWithConfig(c, func(cfg *xray.Config) { cfg.Emitter = emitter }), req)
+	}
+	srv := &testServer{}
+	client := startTestServer(t, srv, []grpc.ServerOption{
+		// Would otherwise close the segment once the call ended, here well after the response was sent
+		grpc.StatsHandler(slowEndHandler{NewStatsHandler()}),
+		grpc.ChainUnaryInterceptor(useEmitter, NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), WithSynchronousEmit(true))),
+	})
+
+	for i := 1; i <= 3; i++ {
+		if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		// No waiting: the segment was emitted before the response was sent
+		emitted := emitter.emitted()
+		if len(emitted) != i || emitted[i-1] != srv.segment() {
+			t.Fatalf("call %d: %d segments emitted, want the segment of every call", i, len(emitted))
+		}
+	}
+}
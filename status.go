@@ -0,0 +1,239 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/exception"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Values of the error.class annotation
+const (
+	ErrorClassNone   = "none"
+	ErrorClassClient = "client"
+	ErrorClassServer = "server"
+)
+
+// Classifies a gRPC code by which side of the call is at fault
+func errorClass(code codes.Code) string {
+	switch code {
+	case codes.OK:
+		return ErrorClassNone
+	case codes.Canceled,
+		codes.InvalidArgument,
+		codes.NotFound,
+		codes.AlreadyExists,
+		codes.PermissionDenied,
+		codes.ResourceExhausted,
+		codes.FailedPrecondition,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.Unauthenticated:
+		return ErrorClassClient
+	default:
+		// Unknown, DeadlineExceeded, Unimplemented, Internal, Unavailable, DataLoss and codes we don't know about
+		return ErrorClassServer
+	}
+}
+
+// Values of the grpc.outcome annotation
+const (
+	OutcomeSuccess     = "success"
+	OutcomeClientError = "client_error"
+	OutcomeServerError = "server_error"
+	OutcomeCanceled    = "canceled"
+)
+
+// Coarsens a gRPC code into the outcome of the call, cancellations are told apart from other client errors
+func outcome(code codes.Code) string {
+	if code == codes.Canceled {
+		return OutcomeCanceled
+	}
+	switch errorClass(code) {
+	case ErrorClassNone:
+		return OutcomeSuccess
+	case ErrorClassClient:
+		return OutcomeClientError
+	default:
+		return OutcomeServerError
+	}
+}
+
+// HTTP status used by nginx (and grpc-gateway) for requests canceled by the client, unknown to net/http
+const statusClientClosedRequest = 499
+
+// Maps a gRPC code to the closest HTTP status, following
+// https://github.com/grpc-ecosystem/grpc-gateway/blob/master/runtime/errors.go
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return statusClientClosedRequest
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		// Unknown, Internal, DataLoss
+		return http.StatusInternalServerError
+	}
+}
+
+// Records the HTTP status mapped from the gRPC code of err on seg and flags it the way the X-Ray SDK's HTTP handler
+// does: throttle and error for 429, error for other 4xx and fault for 5xx. err is recorded as an exception. With
+// WithDisableHTTPStatus the gRPC code is recorded as the grpc.status_code annotation instead of the HTTP status.
+// When flag is false only the status is recorded, for errors that are expected. seg must not be locked by the
+// caller.
+func (o *options) recordStatus(seg segment, err error, flag bool) {
+	grpcCode := status.Code(err)
+	code := httpStatusFromCode(grpcCode)
+	if o.disableHTTPStatus {
+		o.addAnnotation(seg, "grpc.status_code", grpcCode.String())
+	} else {
+		seg.setResponseStatus(code)
+	}
+	if !flag {
+		return
+	}
+	switch {
+	case code == http.StatusTooManyRequests:
+		seg.setThrottle()
+		seg.setError()
+	case code >= 400 && code < 500:
+		seg.setError()
+	case code >= 500:
+		seg.setFault()
+	}
+
+	if err != nil {
+		seg.recordException(err)
+	}
+}
+
+// Records the outcome of a call that returned err on seg: its status and flags (see recordStatus), the
+// error.class, grpc.outcome and grpc.cancel_origin annotations and the grpc.status_text metadata. seg must not be
+// locked by the caller.
+func (o *options) recordOutcome(seg segment, err error, flag bool) {
+	o.recordStatus(seg, err, flag)
+
+	code := status.Code(err)
+	o.addAnnotation(seg, "error.class", errorClass(code))
+	o.addAnnotation(seg, "grpc.outcome", outcome(code))
+	o.addMetadata(seg, "grpc.status_text", httpStatusText(httpStatusFromCode(code)))
+	if origin := cancelOrigin(err); origin != "" {
+		o.addAnnotation(seg, "grpc.cancel_origin", origin)
+	}
+}
+
+// Records err as an exception on seg. Unlike AddError (and Close with an error) this does not flag seg as a fault.
+// Nothing is recorded when the SDK is disabled (AWS_XRAY_SDK_DISABLED), its segments then have no parent. The
+// caller must hold the lock of seg.
+func addException(seg *xray.Segment, err error) {
+	if xray.SdkDisabled() || seg.ParentSegment == nil {
+		return
+	}
+	seg.GetCause().Exceptions = append(seg.GetCause().Exceptions, exceptionFormatter(seg).ExceptionFromError(err))
+}
+
+// Returns the exception formatting strategy configured for seg, the SDK's default when there is none
+func exceptionFormatter(seg *xray.Segment) exception.FormattingStrategy {
+	if seg.ParentSegment != nil {
+		if s := seg.ParentSegment.GetConfiguration().ExceptionFormattingStrategy; s != nil {
+			return s
+		}
+	}
+	s, _ := exception.NewDefaultFormattingStrategy()
+	return s
+}
+
+// Returns the grpc.cancel_origin annotation value for err: "client" when the caller canceled the call, "deadline"
+// when its deadline expired, "" for errors that are not cancellations
+func cancelOrigin(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled), status.Code(err) == codes.Canceled:
+		return "client"
+	case errors.Is(err, context.DeadlineExceeded), status.Code(err) == codes.DeadlineExceeded:
+		return "deadline"
+	default:
+		return ""
+	}
+}
+
+// Implemented by application errors that carry a domain specific error code, see WithBusinessCode
+type businessCoder interface {
+	BusinessCode() string
+}
+
+// Returns the business code of err or of an error it wraps, "" when there is none
+func businessCode(err error) string {
+	var bc businessCoder
+	if errors.As(err, &bc) {
+		return bc.BusinessCode()
+	}
+	return ""
+}
+
+// Appends traceID to the status message of err, keeping its code and details. Errors without a status become
+// Unknown, as grpc-go would send them.
+func withTraceID(err error, traceID string) error {
+	p := status.Convert(err).Proto()
+	p.Message = fmt.Sprintf("%s [trace: %s]", p.Message, traceID)
+	return status.ErrorProto(p)
+}
+
+// Returns the reason phrase of an HTTP status, including the non-standard ones httpStatusFromCode returns
+func httpStatusText(code int) string {
+	if code == statusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(code)
+}
+
+// Fragments of the messages grpc-go uses when a call fails below the application, e.g.
+// `connection error: desc = "transport: Error while dialing dial tcp 10.0.0.1:3000: connect: connection refused"`
+var transportErrorPatterns = []string{
+	"transport",
+	"connection error",
+	"connection refused",
+	"connection reset",
+	"connection closed",
+	"no such host",
+	"i/o timeout",
+	"subconns",
+}
+
+// Best-effort detection of errors caused by the network or the connection rather than the remote handler
+func isTransportError(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.Unavailable {
+		return false
+	}
+	msg := strings.ToLower(s.Message())
+	for _, pattern := range transportErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
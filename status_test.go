@@ -0,0 +1,330 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want string
+	}{
+		{codes.OK, ErrorClassNone},
+		{codes.Canceled, ErrorClassClient},
+		{codes.InvalidArgument, ErrorClassClient},
+		{codes.NotFound, ErrorClassClient},
+		{codes.AlreadyExists, ErrorClassClient},
+		{codes.PermissionDenied, ErrorClassClient},
+		{codes.ResourceExhausted, ErrorClassClient},
+		{codes.FailedPrecondition, ErrorClassClient},
+		{codes.Aborted, ErrorClassClient},
+		{codes.OutOfRange, ErrorClassClient},
+		{codes.Unauthenticated, ErrorClassClient},
+		{codes.Unknown, ErrorClassServer},
+		{codes.DeadlineExceeded, ErrorClassServer},
+		{codes.Unimplemented, ErrorClassServer},
+		{codes.Internal, ErrorClassServer},
+		{codes.Unavailable, ErrorClassServer},
+		{codes.DataLoss, ErrorClassServer},
+		{codes.Code(42), ErrorClassServer},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.code); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestErrorClassAnnotation(t *testing.T) {
+	err := status.Error(codes.NotFound, "no such thing")
+	seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, err
+	})
+	assertAnnotation(t, seg, "error.class", ErrorClassClient)
+
+	sub, _ := invokeUnary(context.Background(), newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return err
+	})
+	assertAnnotation(t, sub, "error.class", ErrorClassClient)
+}
+
+func TestTransportErrorAnnotation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing dial tcp: connection refused\""), true},
+		{"unavailable handler", status.Error(codes.Unavailable, "maintenance window"), false},
+		{"other code", status.Error(codes.Internal, "transport is broken"), false},
+		{"not a status", context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := isTransportError(tt.err); got != tt.want {
+			t.Errorf("%s: isTransportError() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	// The test connection fails to dial, as an unreachable backend would
+	cc := newTestConn(t)
+	sub, err := invokeUnary(context.Background(), cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return cc.Invoke(ctx, method, &testpb.SimpleRequest{}, &testpb.SimpleResponse{}, opts...)
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("err = %v, want Unavailable", err)
+	}
+	assertAnnotation(t, sub, "grpc.transport_error", true)
+
+	sub, _ = invokeUnary(context.Background(), cc, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return tests[1].err
+	})
+	assertNoAnnotation(t, sub, "grpc.transport_error")
+}
+
+func TestStatusText(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want string
+	}{
+		{codes.OK, "OK"},
+		{codes.NotFound, "Not Found"},
+		{codes.Unavailable, "Service Unavailable"},
+		{codes.Canceled, "Client Closed Request"},
+	}
+	for _, tt := range tests {
+		seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+			return nil, status.Error(tt.code, "")
+		})
+		if got := metadataOf(seg)["grpc.status_text"]; got != tt.want {
+			t.Errorf("%v: grpc.status_text = %v, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestSDKDisabled(t *testing.T) {
+	defer os.Setenv("AWS_XRAY_SDK_DISABLED", os.Getenv("AWS_XRAY_SDK_DISABLED"))
+	os.Setenv("AWS_XRAY_SDK_DISABLED", "true")
+	failure := status.Error(codes.Internal, "boom")
+
+	_, _, err := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, failure
+	})
+	if err != failure {
+		t.Errorf("server: err = %v, want the handler error", err)
+	}
+
+	_, err = invokeUnary(context.Background(), newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("client: err = %v, want the invoker error", err)
+	}
+
+	ctx, seg := xray.BeginSegment(context.Background(), "test")
+	defer seg.Close(nil)
+	if err := CaptureAuth(ctx, func(context.Context) error { return failure }); err != failure {
+		t.Errorf("CaptureAuth: err = %v, want the error of fn", err)
+	}
+}
+
+func TestClientStatus(t *testing.T) {
+	tests := []struct {
+		code                   codes.Code
+		want                   int
+		fault, isErr, throttle bool
+	}{
+		{codes.OK, 200, false, false, false},
+		{codes.NotFound, 404, false, true, false},
+		{codes.ResourceExhausted, 429, false, true, true},
+		{codes.Internal, 500, true, false, false},
+		{codes.Unavailable, 503, true, false, false},
+	}
+	for _, tt := range tests {
+		sub, _ := invokeUnary(context.Background(), newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return status.Error(tt.code, "failed")
+		})
+		code, fault, isErr, throttle := segmentStatus(sub)
+		if code != tt.want || fault != tt.fault || isErr != tt.isErr || throttle != tt.throttle {
+			t.Errorf("%v: status %d, fault %t, error %t, throttle %t, want %d, %t, %t, %t",
+				tt.code, code, fault, isErr, throttle, tt.want, tt.fault, tt.isErr, tt.throttle)
+		}
+		sub.RLock()
+		exceptions := len(sub.GetCause().Exceptions)
+		sub.RUnlock()
+		if want := btoi(tt.code != codes.OK); exceptions != want {
+			t.Errorf("%v: %d exceptions, want %d", tt.code, exceptions, want)
+		}
+	}
+}
+
+func TestAddExceptionWithoutFormattingStrategy(t *testing.T) {
+	_, seg := xray.BeginSegment(context.Background(), "test")
+	defer seg.Close(nil)
+	seg.Lock()
+	seg.GetConfiguration().ExceptionFormattingStrategy = nil
+	addException(seg, errors.New("boom"))
+	exceptions := seg.GetCause().Exceptions
+	seg.Unlock()
+	if len(exceptions) != 1 || exceptions[0].Message != "boom" {
+		t.Errorf("exceptions = %+v, want the error formatted by the default strategy", exceptions)
+	}
+}
+
+// Carries a domain error code, like the errors our handlers return
+type businessError struct {
+	code string
+}
+
+func (e businessError) Error() string        { return "business rule violated" }
+func (e businessError) BusinessCode() string { return e.code }
+
+func TestBusinessCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"direct", businessError{"ORDER_LIMIT"}, "ORDER_LIMIT"},
+		{"wrapped", fmt.Errorf("placing order: %w", businessError{"ORDER_LIMIT"}), "ORDER_LIMIT"},
+		{"empty", businessError{""}, ""},
+		{"plain", errors.New("boom"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+				return nil, tt.err
+			}, WithBusinessCode(true))
+			if tt.want == "" {
+				assertNoAnnotation(t, seg, "business.code")
+			} else {
+				assertAnnotation(t, seg, "business.code", tt.want)
+			}
+		})
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, businessError{"ORDER_LIMIT"}
+	})
+	assertNoAnnotation(t, seg, "business.code")
+}
+
+func TestCancelOrigin(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"context canceled", context.Canceled, "client"},
+		{"status canceled", status.Error(codes.Canceled, "context canceled"), "client"},
+		{"context deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), "deadline"},
+		{"status deadline", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), "deadline"},
+		{"other", status.Error(codes.Internal, "boom"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+				return nil, tt.err
+			})
+			sub, _ := invokeUnary(context.Background(), newTestConn(t), func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+				return tt.err
+			})
+			for _, s := range []*xray.Segment{seg, sub} {
+				if tt.want == "" {
+					assertNoAnnotation(t, s, "grpc.cancel_origin")
+				} else {
+					assertAnnotation(t, s, "grpc.cancel_origin", tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableHTTPStatus(t *testing.T) {
+	failing := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.ResourceExhausted, "slow down")
+	}
+	seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such thing")
+	}, WithDisableHTTPStatus(true))
+	sub, _ := invokeUnary(context.Background(), newTestConn(t), failing, WithDisableHTTPStatus(true))
+
+	tests := []struct {
+		seg                      *xray.Segment
+		code                     string
+		fault, isError, throttle bool
+	}{
+		{seg, "NotFound", false, true, false},
+		{sub, "ResourceExhausted", false, true, true},
+	}
+	for _, tt := range tests {
+		assertAnnotation(t, tt.seg, "grpc.status_code", tt.code)
+		code, fault, isError, throttle := segmentStatus(tt.seg)
+		if code != 0 {
+			t.Errorf("%s: HTTP status = %d, want none", tt.seg.Name, code)
+		}
+		if fault != tt.fault || isError != tt.isError || throttle != tt.throttle {
+			t.Errorf("%s: fault, error, throttle = %t, %t, %t, want %t, %t, %t", tt.seg.Name, fault, isError, throttle, tt.fault, tt.isError, tt.throttle)
+		}
+	}
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.status_code")
+	if code, _, _, _ := segmentStatus(seg); code != 200 {
+		t.Errorf("status = %d, want 200 by default", code)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want string
+	}{
+		{codes.OK, OutcomeSuccess},
+		{codes.Canceled, OutcomeCanceled},
+		{codes.InvalidArgument, OutcomeClientError},
+		{codes.NotFound, OutcomeClientError},
+		{codes.AlreadyExists, OutcomeClientError},
+		{codes.PermissionDenied, OutcomeClientError},
+		{codes.ResourceExhausted, OutcomeClientError},
+		{codes.FailedPrecondition, OutcomeClientError},
+		{codes.Aborted, OutcomeClientError},
+		{codes.OutOfRange, OutcomeClientError},
+		{codes.Unauthenticated, OutcomeClientError},
+		{codes.Unknown, OutcomeServerError},
+		{codes.DeadlineExceeded, OutcomeServerError},
+		{codes.Unimplemented, OutcomeServerError},
+		{codes.Internal, OutcomeServerError},
+		{codes.Unavailable, OutcomeServerError},
+		{codes.DataLoss, OutcomeServerError},
+		{codes.Code(42), OutcomeServerError},
+	}
+	cc := newTestConn(t)
+	for _, tt := range tests {
+		if got := outcome(tt.code); got != tt.want {
+			t.Errorf("outcome(%v) = %q, want %q", tt.code, got, tt.want)
+		}
+
+		var err error
+		if tt.code != codes.OK {
+			err = status.Error(tt.code, "failed")
+		}
+		seg, _, _ := serveUnary(context.Background(), nil, func(context.Context, interface{}) (interface{}, error) {
+			return nil, err
+		})
+		sub, _ := invokeUnary(context.Background(), cc, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return err
+		})
+		assertAnnotation(t, seg, "grpc.outcome", tt.want)
+		assertAnnotation(t, sub, "grpc.outcome", tt.want)
+	}
+}
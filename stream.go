@@ -0,0 +1,348 @@
+package xray_grpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a StreamClientInterceptor, the streaming counterpart of NewGrpcXrayUnaryClientInterceptor. The subsegment
+// is opened when the stream is created and closed once the stream completes, i.e. when RecvMsg returns an error
+// (io.EOF included), the response of a client-streaming call was received, or ctx is done. For bidirectional
+// streams the trace header is sent once when the stream is opened, and the subsegment spans messages in both
+// directions: CloseSend does not end it, the server's status ending the receive direction does. Request/response
+// annotators are not called for streams.
+// Usage:
+//
+// conn, err := grpc.Dial("my-service.my-namespace.local:3000",
+//                        grpc.WithInsecure(),
+//                        grpc.WithStreamInterceptor(xray_grpc.NewGrpcXrayStreamClientInterceptor(customHostFromTarget)))
+//
+func NewGrpcXrayStreamClientInterceptor(hostFromTarget func(string) string, opts ...Option) grpc.StreamClientInterceptor {
+	return newOptions(opts).streamClientInterceptor(hostFromTarget)
+}
+
+// Builds the interceptor returned by NewGrpcXrayStreamClientInterceptor from resolved options
+func (o *options) streamClientInterceptor(hostFromTarget func(string) string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+		ctx, trace := o.startClientCall(ctx, method)
+		if !trace {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		ctx, seg := xray.BeginSubsegment(ctx, o.attemptName(ctx, o.subsegmentName(hostFromTarget, cc, method)))
+
+		// If no segment is found, continue on
+		if seg == nil {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		ctx, fallback := o.beginClientSubsegment(ctx, seg, cc, method)
+
+		// Lets a stats handler from NewStatsHandler report what it observed on the wire
+		ctx, wire := withWireStats(ctx, o.now)
+
+		// Capture the peer so the transport security can be recorded once the call completes
+		p := &peer.Peer{}
+		cs, err := streamer(ctx, desc, cc, method, append(append([]grpc.CallOption{fallback}, opts...), grpc.Peer(p))...)
+		if err != nil {
+			o.endClientSubsegment(ctx, seg, p, err)
+			seg.Close(nil)
+			return nil, err
+		}
+
+		s := &clientStream{
+			ClientStream:   cs,
+			messageCounter: messageCounter{wire: wire},
+			o:              o,
+			seg:            seg,
+			peer:           p,
+			desc:           desc,
+			done:           make(chan struct{}),
+		}
+
+		// Don't leave the subsegment open when the caller abandons the stream
+		if ctx.Done() != nil {
+			go func() {
+				select {
+				case <-ctx.Done():
+					s.finish(status.FromContextError(ctx.Err()).Err())
+				case <-s.done:
+				}
+			}()
+		}
+
+		return s, nil
+	}
+}
+
+// Returns a StreamServerInterceptor, the streaming counterpart of NewGrpcXrayUnaryServerInterceptor. The segment
+// spans the whole stream, until the handler returns, and is available from the stream's context. Request/response
+// annotators are not called for streams.
+// Usage:
+//
+// s := grpc.NewServer(grpc.StreamInterceptor(xray_grpc.NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("my-service"))))
+//
+func NewGrpcXrayStreamServerInterceptor(sn xray.SegmentNamer, opts ...Option) grpc.StreamServerInterceptor {
+	return newServerOptions(opts).streamServerInterceptor(sn)
+}
+
+// Builds the interceptor returned by NewGrpcXrayStreamServerInterceptor from resolved options
+func (o *options) streamServerInterceptor(sn xray.SegmentNamer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+		// On the clock set with WithClock, unlike the start time the SDK records
+		start := o.now()
+		ctx, seg, err := o.beginServerSegment(ss.Context(), sn, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if seg == nil {
+			return handler(srv, ss)
+		}
+		defer closeServerSegment(seg)
+		o.addAnnotation(xraySegment{seg}, "grpc.method_type", methodType(info.IsClientStream, info.IsServerStream))
+		if o.traceTrailers {
+			ss.SetTrailer(traceTrailer(seg))
+		}
+
+		s := &serverStream{
+			ServerStream:   ss,
+			messageCounter: messageCounter{wire: wireStatsFromContext(ctx)},
+			ctx:            ctx,
+			o:              o,
+		}
+		if o.appStatusHeader != "" {
+			s.appStatus = &appStatusRecorder{key: o.appStatusHeader}
+		}
+
+		// Handle Request
+		err = handler(srv, s)
+
+		if !o.endServerSegment(ctx, seg, info.FullMethod, start, err) {
+			return o.serverError(seg, err)
+		}
+		s.record(o, seg, false)
+		if o.subsegmentCount {
+			o.addAnnotation(xraySegment{seg}, "grpc.subsegment_count", trackedSubsegments(ctx))
+		}
+		if s.appStatus != nil {
+			s.appStatus.record(o, seg)
+		}
+		// Surfaces server streams that close without sending anything, e.g. on an immediate error
+		if info.IsServerStream {
+			s.Lock()
+			sent := s.sent
+			s.Unlock()
+			o.addAnnotation(xraySegment{seg}, "grpc.stream.premature_end", sent == 0)
+		}
+		if o.onSegmentEnd != nil {
+			o.runHook("WithOnSegmentEnd", func() { o.onSegmentEnd(ctx, seg, err) })
+		}
+
+		return o.serverError(seg, err)
+	}
+}
+
+// Counts the messages of a stream and, when enabled with WithStreamContentLength, their sizes
+type messageCounter struct {
+	sync.Mutex
+	sent, recv           int
+	sentBytes, recvBytes int
+
+	// Observed by the stats handler from NewStatsHandler, if registered
+	wire *wireStats
+}
+
+func (c *messageCounter) countSent(o *options, m interface{}) {
+	size := c.messageSize(o, m)
+	c.Lock()
+	c.sent++
+	c.sentBytes += size
+	c.Unlock()
+}
+
+func (c *messageCounter) countRecv(o *options, m interface{}) {
+	size := c.messageSize(o, m)
+	c.Lock()
+	c.recv++
+	c.recvBytes += size
+	c.Unlock()
+}
+
+// Don't compute sizes the stats handler already measures
+func (c *messageCounter) messageSize(o *options, m interface{}) int {
+	if _, measured := c.wire.snapshot(); measured {
+		return 0
+	}
+	return o.messageSize(m)
+}
+
+// Records the counted messages on seg, client tells which side of the stream seg belongs to
+func (c *messageCounter) record(o *options, seg *xray.Segment, client bool) {
+	c.Lock()
+	sent, recv := c.sent, c.recv
+	sentBytes, recvBytes := c.sentBytes, c.recvBytes
+	c.Unlock()
+
+	// Prefer the precise wire sizes
+	if snap, measured := c.wire.snapshot(); measured {
+		o.recordWireStats(seg, snap, client)
+	} else if o.streamContentLength {
+		if client {
+			o.recordPayloadSizes(seg, sentBytes, recvBytes)
+		} else {
+			o.recordPayloadSizes(seg, recvBytes, sentBytes)
+		}
+	}
+
+	if o.messageCounts {
+		o.addAnnotation(xraySegment{seg}, "grpc.sent_count", sent)
+		o.addAnnotation(xraySegment{seg}, "grpc.recv_count", recv)
+	}
+}
+
+// Returns the encoded size of m, or 0 when sizes are not computed for streams, m is not a proto message or its size
+// can not be computed
+func (o *options) messageSize(m interface{}) (size int) {
+	if !o.streamContentLength {
+		return 0
+	}
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return 0
+	}
+	// Malformed dynamically built messages may panic, which must not break the call
+	defer func() {
+		if r := recover(); r != nil {
+			o.warnf("xray_grpc: unable to compute the size of %T: %v", m, r)
+			size = 0
+		}
+	}()
+	return proto.Size(pm)
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	messageCounter
+
+	o    *options
+	seg  *xray.Segment
+	peer *peer.Peer
+	desc *grpc.StreamDesc
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	switch {
+	case err == nil:
+		s.countSent(s.o, m)
+	// grpc-go ends the stream on errors other than io.EOF, which are raised by the client itself
+	case err != io.EOF && s.o.closeStreamOnError:
+		s.finish(err)
+	}
+	// Otherwise the actual status is returned by RecvMsg, which completes the subsegment
+	return err
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == nil:
+		s.countRecv(s.o, m)
+		// Without server streaming the single response completes the call
+		if !s.desc.ServerStreams {
+			s.finish(nil)
+		}
+	// Only returned once the server ended the call, a half-close with CloseSend leaves bidi streams open
+	case err == io.EOF:
+		s.finish(nil)
+	default:
+		s.finish(err)
+	}
+	return err
+}
+
+// Records the outcome and closes the subsegment, only the first call has an effect
+func (s *clientStream) finish(err error) {
+	s.once.Do(func() {
+		close(s.done)
+		s.o.endClientSubsegment(s.Context(), s.seg, s.peer, err)
+		s.record(s.o, s.seg, true)
+		s.seg.Close(nil)
+	})
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	messageCounter
+
+	ctx       context.Context
+	o         *options
+	appStatus *appStatusRecorder
+}
+
+// Returns the context carrying the segment
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) SetHeader(md metadata.MD) error {
+	if s.appStatus != nil {
+		s.appStatus.observe(md)
+	}
+	return s.ServerStream.SetHeader(md)
+}
+
+func (s *serverStream) SendHeader(md metadata.MD) error {
+	if s.appStatus != nil {
+		s.appStatus.observe(md)
+	}
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.countSent(s.o, m)
+	}
+	return err
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	var err error
+	if s.o.recvSubsegments {
+		// The outcome of the stream is recorded on its segment
+		xray.Capture(s.ctx, "recv", func(context.Context) error {
+			err = s.ServerStream.RecvMsg(m)
+			return nil
+		})
+	} else {
+		err = s.ServerStream.RecvMsg(m)
+	}
+	if err == nil {
+		s.countRecv(s.o, m)
+	}
+	return err
+}
+
+// Reports whether m is nil, including typed nil pointers such as (*pb.Response)(nil)
+func isNilMessage(m interface{}) bool {
+	if m == nil {
+		return true
+	}
+	v := reflect.ValueOf(m)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
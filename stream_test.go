@@ -0,0 +1,328 @@
+package xray_grpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+// Sends payloads on a FullDuplexCall of client and receives their echoes until the server ends the stream
+func fullDuplex(t *testing.T, client testpb.TestServiceClient, payloads ...string) {
+	t.Helper()
+	stream, err := client.FullDuplexCall(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payloads {
+		if err := stream.Send(&testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: []byte(p)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamContentLength(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		srv := &testServer{}
+		interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithStreamContentLength(enabled))
+		fullDuplex(t, startTestServer(t, srv, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)}), "ping", "pong")
+
+		seg := srv.segment()
+		waitClosed(t, seg)
+		seg.RLock()
+		length := seg.GetHTTP().GetResponse().ContentLength
+		seg.RUnlock()
+		if enabled && length == 0 {
+			t.Error("no content length recorded with WithStreamContentLength(true)")
+		}
+		if !enabled && length != 0 {
+			t.Errorf("content length = %d, want none computed by default", length)
+		}
+	}
+
+	o := newOptions(nil)
+	if size := o.messageSize(&testpb.Payload{Body: []byte("ping")}); size != 0 {
+		t.Errorf("messageSize() = %d, want 0 when disabled", size)
+	}
+}
+
+func TestBidiStreamTraceContinuity(t *testing.T) {
+	var sub *xray.Segment
+	capture := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		sub = xray.GetSegment(ctx)
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	srv := &testServer{}
+	client := startTestServer(t, srv,
+		[]grpc.ServerOption{grpc.StreamInterceptor(NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithMessageCounts(true)))},
+		grpc.WithChainStreamInterceptor(NewGrpcXrayStreamClientInterceptor(nil, WithMessageCounts(true)), capture))
+
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	stream, err := client.FullDuplexCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		if err := stream.Send(&testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: []byte(p)}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if segmentClosed(sub) {
+		t.Error("client subsegment closed by CloseSend, want it open until the server ends the stream")
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v, want io.EOF", err)
+	}
+	if !segmentClosed(sub) {
+		t.Error("client subsegment left open after the stream ended")
+	}
+
+	seg := srv.segment()
+	waitClosed(t, seg)
+	if seg.TraceID != root.TraceID || seg.ParentID != sub.ID {
+		t.Errorf("server continued trace %s from %s, want %s from %s", seg.TraceID, seg.ParentID, root.TraceID, sub.ID)
+	}
+	// One segment on each side spans messages in both directions
+	for _, s := range []*xray.Segment{seg, sub} {
+		assertAnnotation(t, s, "grpc.sent_count", 3)
+		assertAnnotation(t, s, "grpc.recv_count", 3)
+	}
+	assertAnnotation(t, seg, "grpc.method_type", "bidi")
+}
+
+// A client stream failing every message with err
+type failingClientStream struct {
+	grpc.ClientStream
+	ctx context.Context
+	err error
+}
+
+func (s *failingClientStream) Context() context.Context  { return s.ctx }
+func (s *failingClientStream) SendMsg(interface{}) error { return s.err }
+func (s *failingClientStream) RecvMsg(interface{}) error { return s.err }
+
+// Opens a stream through the stream client interceptor built with opts, returning it with its subsegment
+func openFailingStream(t *testing.T, ctx context.Context, err error, opts ...Option) (grpc.ClientStream, *xray.Segment) {
+	t.Helper()
+	var sub *xray.Segment
+	interceptor := NewGrpcXrayStreamClientInterceptor(nil, opts...)
+	cs, openErr := interceptor(ctx, &grpc.StreamDesc{ServerStreams: true}, newTestConn(t), testMethod,
+		func(ctx context.Context, _ *grpc.StreamDesc, _ *grpc.ClientConn, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+			sub = xray.GetSegment(ctx)
+			return &failingClientStream{ctx: ctx, err: err}, nil
+		})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	return cs, sub
+}
+
+func TestCloseStreamOnError(t *testing.T) {
+	ctx, root := xray.BeginSegment(context.Background(), "test")
+	defer root.Close(nil)
+	failure := status.Error(codes.Unavailable, "connection reset")
+
+	cs, sub := openFailingStream(t, ctx, failure, WithCloseStreamOnError(true))
+	cs.SendMsg(&testpb.StreamingOutputCallRequest{})
+	if !segmentClosed(sub) {
+		t.Error("subsegment left open after SendMsg failed")
+	}
+	if code, fault, _, _ := segmentStatus(sub); code != 503 || !fault {
+		t.Errorf("status %d, fault %t, want the SendMsg error recorded", code, fault)
+	}
+
+	cs, sub = openFailingStream(t, ctx, failure)
+	cs.SendMsg(&testpb.StreamingOutputCallRequest{})
+	if segmentClosed(sub) {
+		t.Error("subsegment closed by SendMsg by default, want it open until RecvMsg")
+	}
+	cs.RecvMsg(&testpb.StreamingOutputCallResponse{})
+	if !segmentClosed(sub) {
+		t.Error("subsegment left open after RecvMsg failed")
+	}
+
+	// io.EOF only tells the caller to read the status
+	cs, sub = openFailingStream(t, ctx, io.EOF, WithCloseStreamOnError(true))
+	cs.SendMsg(&testpb.StreamingOutputCallRequest{})
+	if segmentClosed(sub) {
+		t.Error("subsegment closed by io.EOF from SendMsg")
+	}
+}
+
+// A server stream that carries ctx and exchanges no messages
+type idleServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *idleServerStream) Context() context.Context { return s.ctx }
+
+func TestMethodTypeAnnotation(t *testing.T) {
+	tests := []struct {
+		clientStream, serverStream bool
+		want                       string
+	}{
+		{false, false, "unary"},
+		{false, true, "server_stream"},
+		{true, false, "client_stream"},
+		{true, true, "bidi"},
+	}
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"))
+	for _, tt := range tests {
+		var seg *xray.Segment
+		ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+		info := &grpc.StreamServerInfo{FullMethod: testMethod, IsClientStream: tt.clientStream, IsServerStream: tt.serverStream}
+		err := interceptor(nil, ss, info, func(_ interface{}, stream grpc.ServerStream) error {
+			seg = xray.GetSegment(stream.Context())
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAnnotation(t, seg, "grpc.method_type", tt.want)
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, nil)
+	assertAnnotation(t, seg, "grpc.method_type", "unary")
+}
+
+func TestStreamPrematureEnd(t *testing.T) {
+	for _, responses := range []int{0, 2} {
+		srv := &testServer{}
+		interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"))
+		client := startTestServer(t, srv, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)})
+
+		stream, err := client.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{
+			ResponseParameters: make([]*testpb.ResponseParameters, responses),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		seg := srv.segment()
+		waitClosed(t, seg)
+		assertAnnotation(t, seg, "grpc.stream.premature_end", responses == 0)
+	}
+}
+
+// A client-streaming server stream that delivers n messages before io.EOF
+type recvServerStream struct {
+	idleServerStream
+	n int
+}
+
+func (s *recvServerStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return io.EOF
+	}
+	s.n--
+	return nil
+}
+
+func TestRecvSubsegments(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		want    int
+	}{
+		// The call returning io.EOF is timed too
+		{true, 4},
+		{false, 0},
+	}
+	for _, tt := range tests {
+		daemon := startFakeDaemon(t)
+		ctx := daemon.context(t, metadata.NewIncomingContext(context.Background(), metadata.MD{}))
+		ss := &recvServerStream{idleServerStream: idleServerStream{ctx: ctx}, n: 3}
+		interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithRecvSubsegments(tt.enabled))
+		info := &grpc.StreamServerInfo{FullMethod: testMethod, IsClientStream: true}
+		err := interceptor(nil, ss, info, func(_ interface{}, stream grpc.ServerStream) error {
+			for {
+				if err := stream.RecvMsg(&testpb.StreamingInputCallRequest{}); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(subsegmentsNamed(daemon.receive(t), "recv")); got != tt.want {
+			t.Errorf("enabled: %t, %d recv subsegments, want %d", tt.enabled, got, tt.want)
+		}
+	}
+}
+
+// A legacy proto message whose size can't be computed, like a malformed dynamically built message
+type panickingMessage struct{}
+
+func (*panickingMessage) Reset()         {}
+func (*panickingMessage) String() string { return "panicking" }
+func (*panickingMessage) ProtoMessage()  {}
+func (*panickingMessage) Marshal() ([]byte, error) {
+	panic("malformed message")
+}
+
+// A server stream that accepts the messages the handler sends
+type sendServerStream struct {
+	idleServerStream
+}
+
+func (s *sendServerStream) SendMsg(interface{}) error { return nil }
+
+func TestMessageSizePanic(t *testing.T) {
+	logger := &recordingLogger{}
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithStreamContentLength(true), WithLogger(logger))
+	ss := &sendServerStream{idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}}
+	var seg *xray.Segment
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod, IsServerStream: true}, func(_ interface{}, stream grpc.ServerStream) error {
+		seg = xray.GetSegment(stream.Context())
+		if err := stream.SendMsg(&panickingMessage{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&testpb.Payload{Body: []byte("ping")})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.RLock()
+	length := seg.GetHTTP().GetResponse().ContentLength
+	seg.RUnlock()
+	if want := proto.Size(&testpb.Payload{Body: []byte("ping")}); length != want {
+		t.Errorf("content length = %d, want %d from the message whose size is known", length, want)
+	}
+	if logged := logger.logged(); len(logged) != 1 || !strings.Contains(logged[0], "panickingMessage") {
+		t.Errorf("logged %q, want a warning about the message", logged)
+	}
+}
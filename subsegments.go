@@ -0,0 +1,66 @@
+package xray_grpc
+
+import (
+	"context"
+	"sync"
+)
+
+type subsegmentTrackerKey struct{}
+
+// Collects the ids of client subsegments created while a server request is being handled
+type subsegmentTracker struct {
+	sync.Mutex
+	ids []string
+}
+
+func withSubsegmentTracker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, subsegmentTrackerKey{}, &subsegmentTracker{})
+}
+
+// Records a subsegment id against the tracker in ctx, if any
+func trackSubsegment(ctx context.Context, id string) {
+	t, ok := ctx.Value(subsegmentTrackerKey{}).(*subsegmentTracker)
+	if !ok {
+		return
+	}
+	t.Lock()
+	// Retries coalesced by WithRetryCoalescing reuse the subsegment of the previous attempt
+	if n := len(t.ids); n == 0 || t.ids[n-1] != id {
+		t.ids = append(t.ids, id)
+	}
+	t.Unlock()
+}
+
+// Returns the number of subsegments recorded against the tracker in ctx, 0 when there is none
+func trackedSubsegments(ctx context.Context) int {
+	t, ok := ctx.Value(subsegmentTrackerKey{}).(*subsegmentTracker)
+	if !ok {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	return len(t.ids)
+}
+
+// Returns the ids of the subsegments created by the client interceptors (unary and stream) and by
+// CaptureGRPCSubsegment for downstream calls made while handling the current request, in the order they were
+// started. ctx must be (or derive from) the context passed to a handler by NewGrpcXrayUnaryServerInterceptor or
+// NewGrpcXrayStreamServerInterceptor, otherwise nil is returned.
+// Usage:
+//
+// func (s *server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+//     ...
+//     ids := xray_grpc.SubsegmentIDsFromContext(ctx)
+// }
+//
+func SubsegmentIDsFromContext(ctx context.Context) []string {
+	t, ok := ctx.Value(subsegmentTrackerKey{}).(*subsegmentTracker)
+	if !ok {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	ids := make([]string, len(t.ids))
+	copy(ids, t.ids)
+	return ids
+}
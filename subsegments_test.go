@@ -0,0 +1,78 @@
+package xray_grpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSubsegmentIDsFromContext(t *testing.T) {
+	cc := newTestConn(t)
+	var ids, want []string
+	_, _, err := serveUnary(context.Background(), nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		for i := 0; i < 2; i++ {
+			seg, err := invokeUnary(ctx, cc, nil)
+			if err != nil {
+				return nil, err
+			}
+			want = append(want, seg.ID)
+		}
+		ids = SubsegmentIDsFromContext(ctx)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 2 || want[0] == want[1] {
+		t.Fatalf("client subsegments = %v, want 2 distinct ids", want)
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("SubsegmentIDsFromContext() = %v, want %v", ids, want)
+	}
+}
+
+func TestSubsegmentIDsFromContextWithoutServerSegment(t *testing.T) {
+	if ids := SubsegmentIDsFromContext(context.Background()); ids != nil {
+		t.Errorf("SubsegmentIDsFromContext() = %v, want nil", ids)
+	}
+}
+
+func TestSubsegmentCount(t *testing.T) {
+	cc := newTestConn(t)
+	fanOut := func(n int) grpc.UnaryHandler {
+		return func(ctx context.Context, _ interface{}) (interface{}, error) {
+			for i := 0; i < n; i++ {
+				if _, err := invokeUnary(ctx, cc, nil); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+	}
+	for _, n := range []int{0, 3} {
+		seg, _, err := serveUnary(context.Background(), nil, fanOut(n), WithSubsegmentCount(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAnnotation(t, seg, "grpc.subsegment_count", n)
+	}
+
+	seg, _, _ := serveUnary(context.Background(), nil, fanOut(1))
+	assertNoAnnotation(t, seg, "grpc.subsegment_count")
+
+	interceptor := NewGrpcXrayStreamServerInterceptor(xray.NewFixedSegmentNamer("test"), WithSubsegmentCount(true))
+	ss := &idleServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: testMethod}, func(_ interface{}, stream grpc.ServerStream) error {
+		seg = xray.GetSegment(stream.Context())
+		_, err := fanOut(2)(stream.Context(), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnnotation(t, seg, "grpc.subsegment_count", 2)
+}
@@ -0,0 +1,94 @@
+package xray_grpc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Largest value the grpc-timeout header accepts in any unit (8 digits)
+const maxTimeoutValue int64 = 100000000 - 1
+
+// Integer division, rounding up
+func divRoundUp(d, r time.Duration) int64 {
+	if d%r > 0 {
+		return int64(d/r + 1)
+	}
+	return int64(d / r)
+}
+
+// Encodes t the same way grpc-go does when writing the grpc-timeout header, see
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
+func encodeTimeout(t time.Duration) string {
+	if t <= 0 {
+		return "0n"
+	}
+	units := []struct {
+		d    time.Duration
+		unit string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+	}
+	for _, u := range units {
+		if v := divRoundUp(t, u.d); v <= maxTimeoutValue {
+			return strconv.FormatInt(v, 10) + u.unit
+		}
+	}
+	return strconv.FormatInt(divRoundUp(t, time.Hour), 10) + "H"
+}
+
+// Decodes a grpc-timeout header value such as "100m" or "5S"
+func decodeTimeout(s string) (time.Duration, error) {
+	size := len(s)
+	if size < 2 || size > 9 {
+		// At least one digit, at most 8, plus the unit
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	var unit time.Duration
+	switch s[size-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("invalid grpc-timeout unit %q", s)
+	}
+	v, err := strconv.ParseInt(s[:size-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q: %v", s, err)
+	}
+	if unit == time.Hour && v > math.MaxInt64/int64(time.Hour) {
+		return time.Duration(math.MaxInt64), nil
+	}
+	return unit * time.Duration(v), nil
+}
+
+// Records when the deadline of ctx was set to expire as grpc.deadline_at, in seconds since the epoch like the
+// start and end times of segments, when err is DeadlineExceeded. Tells deadlines that fire early from errors that
+// surface late. seg must not be locked.
+func (o *options) recordDeadline(ctx context.Context, seg *xray.Segment, err error) {
+	if status.Code(err) != codes.DeadlineExceeded {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		o.addMetadata(xraySegment{seg}, "grpc.deadline_at", float64(deadline.UnixNano())/float64(time.Second))
+	}
+}
@@ -0,0 +1,90 @@
+package xray_grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerTimeoutAnnotation(t *testing.T) {
+	seg, _, _ := serveUnary(context.Background(), metadata.Pairs("grpc-timeout", "100m"), nil)
+	assertAnnotation(t, seg, "grpc.timeout", "100m")
+	assertAnnotation(t, seg, "grpc.timeout_ms", float64(100))
+
+	// grpc-go turns the header into the deadline of the context before the interceptor runs
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	seg, _, _ = serveUnary(ctx, nil, nil)
+	value, _ := annotations(seg)["grpc.timeout"].(string)
+	if d, err := decodeTimeout(value); err != nil || d <= time.Second || d > 2*time.Second {
+		t.Errorf("grpc.timeout = %q, want within (1S, 2S]", value)
+	}
+	if ms, _ := annotations(seg)["grpc.timeout_ms"].(float64); ms <= 1000 || ms > 2000 {
+		t.Errorf("grpc.timeout_ms = %v, want within (1000, 2000]", ms)
+	}
+
+	seg, _, _ = serveUnary(context.Background(), nil, nil)
+	assertNoAnnotation(t, seg, "grpc.timeout")
+}
+
+func TestDecodeTimeout(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"5S", 5 * time.Second},
+		{"100m", 100 * time.Millisecond},
+		{"3u", 3 * time.Microsecond},
+		{"7n", 7},
+		{"2M", 2 * time.Minute},
+		{"1H", time.Hour},
+	}
+	for _, tt := range tests {
+		if got, err := decodeTimeout(tt.in); err != nil || got != tt.want {
+			t.Errorf("decodeTimeout(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "5", "5x", "abcm", "1234567890S"} {
+		if _, err := decodeTimeout(in); err == nil {
+			t.Errorf("decodeTimeout(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestDeadlineAtMetadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	want := float64(deadline.UnixNano()) / float64(time.Second)
+
+	seg, _, err := serveUnary(ctx, nil, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	sub, _ := invokeUnary(ctx, newTestConn(t), func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		<-ctx.Done()
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	})
+	for _, s := range []*xray.Segment{seg, sub} {
+		if got := metadataOf(s)["grpc.deadline_at"]; got != want {
+			t.Errorf("%s: grpc.deadline_at = %v, want %v", s.Name, got, want)
+		}
+	}
+
+	// Only recorded when the deadline is what failed the call
+	seg, _, _ = serveUnary(ctx, nil, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "boom")
+	})
+	if got := metadataOf(seg)["grpc.deadline_at"]; got != nil {
+		t.Errorf("grpc.deadline_at = %v, want none for other errors", got)
+	}
+}
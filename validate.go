@@ -0,0 +1,34 @@
+package xray_grpc
+
+import (
+	"context"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// Implemented by messages generated with protoc-gen-validate
+type validator interface {
+	Validate() error
+}
+
+// Times the validation of req in a "validate" subsegment, flagging a failed validation as an error (not a fault,
+// the request is malformed) and recording it as an exception. The result is only recorded, rejecting invalid
+// requests is left to the handler.
+func captureValidation(ctx context.Context, req interface{}) {
+	v, ok := req.(validator)
+	if !ok {
+		return
+	}
+	_ = xray.Capture(ctx, "validate", func(ctx context.Context) error {
+		// Closing the subsegment with the error would flag it as a fault
+		if err := v.Validate(); err != nil {
+			if seg := xray.GetSegment(ctx); seg != nil {
+				seg.Lock()
+				seg.Error = true
+				addException(seg, err)
+				seg.Unlock()
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package xray_grpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Validates like messages generated by protoc-gen-validate
+type validatedRequest struct {
+	err error
+}
+
+func (r validatedRequest) Validate() error {
+	return r.err
+}
+
+func TestValidationSubsegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		err     error
+		wantSub bool
+	}{
+		{"valid", []Option{WithValidationSubsegment(true)}, nil, true},
+		{"invalid", []Option{WithValidationSubsegment(true)}, errors.New("invalid Request.Name: value length must be at least 1 runes"), true},
+		{"disabled", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daemon := startFakeDaemon(t)
+			interceptor := NewGrpcXrayUnaryServerInterceptor(xray.NewFixedSegmentNamer("test"), tt.opts...)
+			_, err := interceptor(daemon.context(t, metadata.NewIncomingContext(context.Background(), metadata.MD{})),
+				validatedRequest{tt.err}, &grpc.UnaryServerInfo{FullMethod: testMethod},
+				func(context.Context, interface{}) (interface{}, error) { return "response", nil })
+			if err != nil {
+				t.Fatalf("err = %v, want the handler to decide on invalid requests", err)
+			}
+
+			subs := subsegmentsNamed(daemon.receive(t), "validate")
+			if !tt.wantSub {
+				if len(subs) != 0 {
+					t.Errorf("validate subsegment recorded when disabled")
+				}
+				return
+			}
+			if len(subs) != 1 {
+				t.Fatalf("%d validate subsegments, want 1", len(subs))
+			}
+			cause, _ := subs[0]["cause"].(map[string]interface{})
+			exceptions, _ := cause["exceptions"].([]interface{})
+			if tt.err == nil && len(exceptions) != 0 {
+				t.Errorf("valid request recorded exceptions %v", exceptions)
+			}
+			if tt.err != nil && (len(exceptions) != 1 || exceptions[0].(map[string]interface{})["message"] != tt.err.Error()) {
+				t.Errorf("exceptions = %v, want the validation error", exceptions)
+			}
+			// A malformed request is the caller's error, not a fault of the server
+			fault, _ := subs[0]["fault"].(bool)
+			isError, _ := subs[0]["error"].(bool)
+			if fault || isError != (tt.err != nil) {
+				t.Errorf("fault %t, error %t, want an error only for invalid requests", fault, isError)
+			}
+		})
+	}
+}